@@ -0,0 +1,77 @@
+package rest_data_archiver
+
+import (
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// The adapter interfaces and the types they depend on, exported so that custom adapters can be
+// implemented outside of this module, with the same optional interfaces as the built-in adapters
+type (
+	Source                = internal.Source
+	Destination           = internal.Destination
+	StreamSource          = internal.StreamSource
+	StreamDestination     = internal.StreamDestination
+	SourceConfig          = internal.SourceConfig
+	DestinationConfig     = internal.DestinationConfig
+	EventLogItem          = internal.EventLogItem
+	EventLogger           = internal.EventLogger
+	AlertedError          = internal.AlertedError
+	SourceReadError       = internal.SourceReadError
+	SourceFactory         = internal.SourceFactory
+	DestinationFactory    = internal.DestinationFactory
+	StateConfig           = internal.StateConfig
+	SetState              = internal.SetState
+	StateStore            = internal.StateStore
+	StatefulSource        = internal.StatefulSource
+	WatermarkSource       = internal.WatermarkSource
+	MetadataSource        = internal.MetadataSource
+	MetadataDestination   = internal.MetadataDestination
+	FormatDestination     = internal.FormatDestination
+	EncryptingDestination = internal.EncryptingDestination
+	ChangeDetector        = internal.ChangeDetector
+	Pruner                = internal.Pruner
+	StateStoreFactory     = internal.StateStoreFactory
+)
+
+// IsAlerted returns true if the error, or an error it wraps, is an AlertedError. A source or
+// destination that has already sent an alert for an error can return it as an AlertedError, so
+// that it is not sent again in the summary of the run's errors.
+func IsAlerted(err error) bool {
+	return internal.IsAlerted(err)
+}
+
+// IsSourceReadError returns true if the error is, or was caused by, a SourceReadError. A
+// destination should return such an error without sending an alert, as it is reported as a
+// failure of the source.
+func IsSourceReadError(err error) bool {
+	return internal.IsSourceReadError(err)
+}
+
+// UnmarshalConfig reads an adapter's config, such as the AdapterConfig or a set's Source or
+// Destination, like json.Unmarshal. Numbers and booleans are also read into string fields, and
+// decimal strings into number fields, so that unquoted YAML values and RDA_ environment overrides
+// are read as they are by the built-in adapters.
+func UnmarshalConfig(data []byte, v interface{}) error {
+	return internal.UnmarshalConfig(data, v)
+}
+
+// RegisterSource makes a custom source adapter available to Run under the given type name,
+// which is matched against the "Type" field of the config's "Source" section. It must be called
+// before Run, and panics if the type is already registered.
+func RegisterSource(sourceType string, factory SourceFactory) {
+	internal.RegisterSource(sourceType, factory)
+}
+
+// RegisterDestination makes a custom destination adapter available to Run under the given type
+// name, which is matched against the "Type" field of the config's "Destination" section. It must
+// be called before Run, and panics if the type is already registered.
+func RegisterDestination(destinationType string, factory DestinationFactory) {
+	internal.RegisterDestination(destinationType, factory)
+}
+
+// RegisterStateStore makes a custom state store available to Run under the given type name,
+// which is matched against the "Type" field of the config's "State" section. It must be called
+// before Run, and panics if the type is already registered.
+func RegisterStateStore(stateStoreType string, factory StateStoreFactory) {
+	internal.RegisterStateStore(stateStoreType, factory)
+}
@@ -6,9 +6,9 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
+
+	"github.com/silinternational/rest-data-archiver/internal/awsutil"
 )
 
 type Config struct {
@@ -19,13 +19,32 @@ type Config struct {
 	RecipientEmails    []string
 	AWSAccessKeyID     string
 	AWSSecretAccessKey string
+
+	// AWSRoleARN is an IAM role to assume to send the email, with an optional AWSExternalID
+	AWSRoleARN    string
+	AWSExternalID string
 }
 
+// SendEmail sends the alert to each recipient using SES. If the AWS access keys are omitted, the
+// default credential chain is used, such as the Lambda execution role.
 func SendEmail(config Config, body string) {
-	if config.AWSAccessKeyID == "" || config.AWSSecretAccessKey == "" {
-		log.Printf("AWS credentials not provided for email alerts")
+	if len(config.RecipientEmails) == 0 {
+		log.Printf("no recipients configured for email alerts")
+		return
+	}
+
+	sess, err := awsutil.NewSession(awsutil.Config{
+		Region:          config.AWSRegion,
+		AccessKeyID:     config.AWSAccessKeyID,
+		SecretAccessKey: config.AWSSecretAccessKey,
+		RoleARN:         config.AWSRoleARN,
+		ExternalID:      config.AWSExternalID,
+	})
+	if err != nil {
+		log.Printf("error creating AWS session for email alerts: %s", err)
 		return
 	}
+	svc := ses.New(sess)
 
 	charSet := config.CharSet
 
@@ -54,7 +73,7 @@ func SendEmail(config Config, body string) {
 
 	// Send emails to one recipient at a time to avoid one bad email sabotaging it all
 	for _, address := range config.RecipientEmails {
-		err := sendAnEmail(emailMsg, address, config)
+		err := sendAnEmail(svc, emailMsg, address, config)
 		if err != nil {
 			lastError = err.Error()
 			badRecipients = append(badRecipients, address)
@@ -68,7 +87,7 @@ func SendEmail(config Config, body string) {
 	}
 }
 
-func sendAnEmail(emailMsg ses.Message, recipient string, config Config) error {
+func sendAnEmail(svc *ses.SES, emailMsg ses.Message, recipient string, config Config) error {
 	recipients := []*string{&recipient}
 
 	input := &ses.SendEmailInput{
@@ -79,16 +98,6 @@ func sendAnEmail(emailMsg ses.Message, recipient string, config Config) error {
 		Source:  aws.String(config.ReturnToAddr),
 	}
 
-	cfg := &aws.Config{Region: aws.String(config.AWSRegion)}
-	if config.AWSAccessKeyID != "" && config.AWSSecretAccessKey != "" {
-		cfg.Credentials = credentials.NewStaticCredentials(config.AWSAccessKeyID, config.AWSSecretAccessKey, "")
-	}
-	sess, err := session.NewSession(cfg)
-	if err != nil {
-		return fmt.Errorf("error creating AWS session: %s", err)
-	}
-
-	svc := ses.New(sess)
 	result, err := svc.SendEmail(input)
 	if err != nil {
 		return fmt.Errorf("error sending email, result: %s, error: %s", result, err)
@@ -1,7 +1,94 @@
 package aws
 
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/silinternational/rest-data-archiver/internal/awsutil"
+)
+
+// Config holds the AWS settings of an adapter. If AccessKeyId and SecretAccessKey are omitted,
+// the default credential chain is used, such as the Lambda execution role.
 type Config struct {
 	AccessKeyId     string
 	SecretAccessKey string
 	Region          string
+
+	// RoleARN is an IAM role to assume, for example to write to a bucket in another account
+	RoleARN string
+
+	// ExternalID is passed when assuming the role, if required by its trust policy
+	ExternalID string
+}
+
+func (c Config) newSession() (*session.Session, error) {
+	return awsutil.NewSession(c.sessionConfig())
+}
+
+func (c Config) validate() error {
+	if c.Region == "" {
+		return fmt.Errorf("config is missing an AWS region")
+	}
+	return c.sessionConfig().Validate()
+}
+
+func (c Config) sessionConfig() awsutil.Config {
+	return awsutil.Config{
+		Region:          c.Region,
+		AccessKeyID:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		RoleARN:         c.RoleARN,
+		ExternalID:      c.ExternalID,
+	}
+}
+
+// S3Endpoint configures access to an S3-compatible service other than AWS, such as MinIO, Ceph or
+// Cloudflare R2
+type S3Endpoint struct {
+	// Endpoint is the URL of the service, such as "https://minio.example.org:9000". Default: AWS
+	Endpoint string
+
+	// ForcePathStyle puts the bucket name in the URL path instead of the host name, as most
+	// S3-compatible services require
+	ForcePathStyle bool
+
+	// DisableSSL uses http instead of https if the Endpoint has no scheme
+	DisableSSL bool
+}
+
+// newS3Client returns an S3 client for the endpoint, using the AWS config's credentials
+func (e S3Endpoint) newS3Client(c Config) (*s3.S3, error) {
+	sess, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	config := aws.NewConfig().WithS3ForcePathStyle(e.ForcePathStyle).WithDisableSSL(e.DisableSSL)
+	if e.Endpoint != "" {
+		config = config.WithEndpoint(e.Endpoint)
+	}
+	return s3.New(sess, config), nil
+}
+
+// sharedS3Client creates an S3 client on first use and shares it between the copies of an adapter
+// made for each set, so that the session and any assumed role's credentials are reused
+type sharedS3Client struct {
+	once   sync.Once
+	client *s3.S3
+	err    error
+}
+
+// get returns the shared client, creating it if needed. A nil sharedS3Client creates a new client.
+func (c *sharedS3Client) get(e S3Endpoint, config Config) (*s3.S3, error) {
+	if c == nil {
+		return e.newS3Client(config)
+	}
+	c.once.Do(func() {
+		c.client, c.err = e.newS3Client(config)
+	})
+	return c.client, c.err
 }
@@ -4,18 +4,28 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/syslog"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/silinternational/rest-data-archiver/internal"
 )
 
 const (
 	DefaultObjectNamePrefix = "data_"
+	DefaultManifestPrefix   = ".rda/"
+	ContentTypeJSON         = "application/json"
+	ContentTypeNDJSON       = "application/x-ndjson"
+	ContentTypeEncrypted    = "application/octet-stream"
+
+	// maxDeleteObjects is the maximum number of keys in a DeleteObjects request
+	maxDeleteObjects = 1000
 )
 
 type S3Adapter struct {
@@ -27,15 +37,69 @@ type S3Adapter struct {
 
 	// S3Set contains configuration that differs for each archive set
 	S3Set S3Set
+
+	setName         string
+	keyTemplate     *internal.ObjectKeyTemplate
+	lastObjectKey   string
+	retention       internal.RetentionPolicy
+	retentionPrefix string
+	retentionKeys   *regexp.Regexp
+	upload          UploadOptions
+	metadataSource  internal.MetadataSource
+	encryptionKey   []byte
+	dataFormat      string
+	client          *sharedS3Client
 }
 
 type S3Config struct {
 	AwsConfig  Config
 	BucketName string
+
+	// Endpoint, ForcePathStyle and DisableSSL configure an S3-compatible service other than AWS
+	S3Endpoint
+
+	// Compression is the default compression type for all sets, "gzip", "zstd" or "none"
+	Compression string
+
+	// Retention is the default retention policy for all sets
+	Retention internal.RetentionPolicy
+
+	// Upload sets the storage class, encryption, tags, metadata and Object Lock of the objects
+	Upload UploadOptions
 }
 
 type S3Set struct {
 	ObjectNamePrefix string `json:"ObjectNamePrefix"`
+
+	// ObjectKeyTemplate builds the object key from variables, replacing the default key of
+	// ObjectNamePrefix followed by a timestamp. See internal.ObjectKeyTemplate for the syntax.
+	ObjectKeyTemplate string
+
+	// Compression overrides the destination's Compression for this set. Use "none" to disable.
+	Compression string
+
+	// ManifestKey is the key of the object recording the hash of the last archive, used by
+	// SkipIfUnchanged. Default: ".rda/<set name>.json"
+	ManifestKey string
+
+	// Retention overrides the destination's Retention policy for this set
+	Retention *internal.RetentionPolicy
+
+	// RetentionPrefix limits the objects subject to the retention policy to those with this key
+	// prefix. Default: the ObjectNamePrefix, or the part of the ObjectKeyTemplate before its
+	// first variable other than {set}.
+	RetentionPrefix string
+
+	// Format converts the records to CSV or Parquet before upload. See internal.OutputFormat.
+	Format *internal.OutputFormat
+
+	// Upload overrides the destination's Upload options for this set. Tags and Metadata are
+	// added to those of the destination.
+	Upload *UploadOptions
+}
+
+func init() {
+	internal.RegisterDestination(internal.DestinationTypeS3, NewS3Destination)
 }
 
 func NewS3Destination(destinationConfig internal.DestinationConfig) (internal.Destination, error) {
@@ -45,6 +109,7 @@ func NewS3Destination(destinationConfig internal.DestinationConfig) (internal.De
 	}
 
 	s.DestinationConfig = destinationConfig
+	s.client = &sharedS3Client{}
 
 	return &s, nil
 }
@@ -52,7 +117,7 @@ func NewS3Destination(destinationConfig internal.DestinationConfig) (internal.De
 func readConfig(data []byte) (S3Adapter, error) {
 	var s S3Adapter
 
-	err := json.Unmarshal(data, &s.S3Config)
+	err := internal.UnmarshalConfig(data, &s.S3Config)
 	if err != nil {
 		return s, fmt.Errorf("error unmarshaling AwsConfig: %s", err)
 	}
@@ -60,45 +125,214 @@ func readConfig(data []byte) (S3Adapter, error) {
 	if s.S3Config.BucketName == "" {
 		return s, fmt.Errorf("config is missing an S3 bucket name")
 	}
-	if s.S3Config.AwsConfig.Region == "" {
-		return s, fmt.Errorf("config is missing an AWS region")
+	if err := s.S3Config.AwsConfig.validate(); err != nil {
+		return s, err
 	}
-	if s.S3Config.AwsConfig.AccessKeyId == "" {
-		return s, fmt.Errorf("config is missing an AWS access key")
+	// "none" is accepted here as it is in the set config
+	if s.S3Config.Compression == "none" {
+		s.S3Config.Compression = internal.CompressionNone
 	}
-	if s.S3Config.AwsConfig.SecretAccessKey == "" {
-		return s, fmt.Errorf("config is missing an AWS secret access key")
+	if err := internal.ValidateCompression(s.S3Config.Compression); err != nil {
+		return s, err
+	}
+	if err := s.S3Config.Retention.Validate(); err != nil {
+		return s, err
+	}
+	if err := s.S3Config.Upload.validate(); err != nil {
+		return s, err
 	}
 
 	return s, nil
 }
 
-func (s *S3Adapter) ForSet(setName string, setConfigJson json.RawMessage) error {
+// ForSet returns a copy of this S3Adapter configured for the given set
+func (s *S3Adapter) ForSet(setName string, setConfigJson json.RawMessage) (internal.Destination, error) {
 	var setConfig S3Set
-	err := json.Unmarshal(setConfigJson, &setConfig)
+	err := internal.UnmarshalConfig(setConfigJson, &setConfig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s.S3Set = setConfig
+	setAdapter := *s
+	setAdapter.S3Set = setConfig
+	setAdapter.setName = setName
 
 	// Defaults
-	if s.S3Set.ObjectNamePrefix == "" {
-		s.S3Set.ObjectNamePrefix = setName + "/" + DefaultObjectNamePrefix
+	if setAdapter.S3Set.ObjectNamePrefix == "" {
+		setAdapter.S3Set.ObjectNamePrefix = setName + "/" + DefaultObjectNamePrefix
+	}
+	if setAdapter.S3Set.ManifestKey == "" {
+		setAdapter.S3Set.ManifestKey = DefaultManifestPrefix + setName + ".json"
+	}
+	switch setAdapter.S3Set.Compression {
+	case "":
+		setAdapter.S3Set.Compression = s.S3Config.Compression
+	case "none":
+		setAdapter.S3Set.Compression = internal.CompressionNone
+	}
+	if err := internal.ValidateCompression(setAdapter.S3Set.Compression); err != nil {
+		return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
 	}
 
-	return nil
+	if f := setAdapter.S3Set.Format; f != nil {
+		if err := f.Validate(); err != nil {
+			return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
+		}
+		// Parquet is compressed internally
+		if f.Type == internal.OutputFormatParquet {
+			setAdapter.S3Set.Compression = internal.CompressionNone
+		}
+	}
+
+	if setAdapter.S3Set.ObjectKeyTemplate != "" {
+		t, err := internal.ParseObjectKeyTemplate(setAdapter.S3Set.ObjectKeyTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
+		}
+		setAdapter.keyTemplate = &t
+	}
+
+	if err := setAdapter.configureRetention(); err != nil {
+		return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
+	}
+
+	setAdapter.upload = s.S3Config.Upload.merge(setAdapter.S3Set.Upload)
+	if err := setAdapter.upload.validate(); err != nil {
+		return nil, fmt.Errorf("bad Upload configuration in set '%s': %s", setName, err)
+	}
+	setAdapter.metadataSource = nil
+	setAdapter.encryptionKey = nil
+	setAdapter.dataFormat = ""
+
+	return &setAdapter, nil
+}
+
+// configureRetention determines the set's retention policy and the prefix of the objects to
+// which it applies
+func (s *S3Adapter) configureRetention() error {
+	s.retention = s.S3Config.Retention
+	s.retentionKeys = nil
+	if s.S3Set.Retention != nil {
+		s.retention = *s.S3Set.Retention
+	}
+	if err := s.retention.Validate(); err != nil {
+		return err
+	}
+	if s.retention.IsEmpty() {
+		return nil
+	}
+
+	s.retentionPrefix = s.S3Set.RetentionPrefix
+	if s.retentionPrefix == "" {
+		if s.keyTemplate != nil {
+			s.retentionPrefix = s.keyTemplate.StaticPrefix(s.setName)
+		} else {
+			s.retentionPrefix = s.S3Set.ObjectNamePrefix
+		}
+	}
+	if s.retentionPrefix == "" {
+		return fmt.Errorf("a RetentionPrefix is required when the ObjectKeyTemplate begins with a variable")
+	}
+
+	// Only objects with keys this set could have written are subject to the policy, since the
+	// prefix may also begin the keys of another set, such as "hr_" and "hr_payroll_..."
+	pattern := regexp.QuoteMeta(s.S3Set.ObjectNamePrefix) + `\d+`
+	if s.keyTemplate != nil {
+		pattern = s.keyTemplate.Pattern(s.setName)
+	}
+	if s.keyTemplate == nil || !s.keyTemplate.Uses(internal.KeyVarExt) {
+		pattern += `(\.` + internal.ExtensionPattern + `)?`
+	}
+	var err error
+	s.retentionKeys, err = regexp.Compile("^" + pattern + "$")
+	return err
 }
 
 func (s *S3Adapter) Write(data []byte, eventLog chan<- internal.EventLogItem) error {
-	filename := fmt.Sprintf("%s%v", s.S3Set.ObjectNamePrefix, time.Now().UnixNano())
-	if err := s.saveObject(data, filename); err != nil {
+	return s.WriteStream(bytes.NewReader(data), eventLog)
+}
+
+// WriteStream uploads the data to S3 as it is read, without holding it all in memory. If a
+// Format is configured, the records are converted first. The data is then compressed, if
+// configured, and finally encrypted, if an encryption key was set. If the object key includes the
+// content hash, the data is first spooled to a temporary file to compute the hash.
+func (s *S3Adapter) WriteStream(data io.Reader, eventLog chan<- internal.EventLogItem) error {
+	format := s.format()
+	keyValues := internal.ObjectKeyValues{
+		SetName: s.setName,
+		RunID:   s.DestinationConfig.RunID,
+		Time:    time.Now(),
+		Ext:     s.extension() + internal.CompressionExtension(s.S3Set.Compression),
+	}
+
+	if !format.IsJSON() {
+		pr, pw := io.Pipe()
+		go func(source io.Reader) {
+			pw.CloseWithError(format.Convert(pw, source))
+		}(data)
+		defer pr.Close()
+		data = pr
+	}
+
+	if (s.keyTemplate != nil && s.keyTemplate.Uses(internal.KeyVarHash)) || s.upload.hasTemplates() {
+		spooled, err := internal.Spool(data)
+		if err != nil {
+			return fmt.Errorf("error buffering data to compute its hash: %s", err)
+		}
+		defer spooled.Close()
+		keyValues.Hash = spooled.Hash
+		data = spooled
+	}
+
+	filename := s.objectKey(keyValues)
+
+	compressed, err := internal.Compress(data, s.S3Set.Compression)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+	data = compressed
+
+	if s.encryptionKey != nil {
+		encrypted, err := internal.Encrypt(data, s.encryptionKey)
+		if err != nil {
+			return fmt.Errorf("error initializing encryption: %s", err)
+		}
+		defer encrypted.Close()
+		data = encrypted
+	}
+
+	templateData := internal.TemplateData{
+		Now:         keyValues.Time,
+		SetName:     s.setName,
+		RunID:       s.DestinationConfig.RunID,
+		ContentHash: keyValues.Hash,
+		Source:      map[string]string{},
+	}
+	if s.metadataSource != nil {
+		templateData.Source = s.metadataSource.SourceMetadata()
+	}
+	for _, name := range s.upload.sourceValues() {
+		if templateData.Source[name] == "" {
+			eventLog <- internal.EventLogItem{
+				Level:   syslog.LOG_WARNING,
+				Message: fmt.Sprintf("the Upload templates use .Source.%s, which the source did not report for this set", name),
+			}
+		}
+	}
+
+	if err := s.saveObject(data, filename, templateData); err != nil {
+		// A failure of the source is reported by RunSet
+		if internal.IsSourceReadError(err) {
+			return err
+		}
 		eventLog <- internal.EventLogItem{
 			Level:   syslog.LOG_ALERT,
 			Message: fmt.Sprintf("error saving to S3: %s", err),
 		}
 		return err
 	}
+	s.lastObjectKey = filename
 	eventLog <- internal.EventLogItem{
 		Level:   syslog.LOG_INFO,
 		Message: fmt.Sprintf("saved to %s on bucket %s", filename, s.S3Config.BucketName),
@@ -106,29 +340,241 @@ func (s *S3Adapter) Write(data []byte, eventLog chan<- internal.EventLogItem) er
 	return nil
 }
 
-func (s *S3Adapter) saveObject(data []byte, fileName string) error {
-	uploader, err := s.createS3Uploader()
+// objectKey returns the key for a new object, using the set's ObjectKeyTemplate if configured.
+// Otherwise, the key is the ObjectNamePrefix followed by a timestamp. If the key doesn't contain
+// the file extension, the extension of the data and the compression extension are appended, as in
+// ".json.gz". Uncompressed JSON keeps the bare key.
+func (s *S3Adapter) objectKey(values internal.ObjectKeyValues) string {
+	ext := internal.CompressionExtension(s.S3Set.Compression)
+	if dataExt := s.extension(); dataExt != internal.OutputFormatJSON || ext != "" {
+		ext = "." + dataExt + ext
+	}
+
+	if s.keyTemplate == nil {
+		return fmt.Sprintf("%s%v%s", s.S3Set.ObjectNamePrefix, values.Time.UnixNano(), ext)
+	}
+
+	key := s.keyTemplate.Execute(values)
+	if !s.keyTemplate.Uses(internal.KeyVarExt) {
+		key += ext
+	}
+	return key
+}
+
+// format returns the set's output format, JSON if not configured
+func (s *S3Adapter) format() internal.OutputFormat {
+	if s.S3Set.Format == nil {
+		return internal.OutputFormat{Type: internal.OutputFormatJSON}
+	}
+	return *s.S3Set.Format
+}
+
+// isNDJSON returns true if the set's data is NDJSON written without conversion
+func (s *S3Adapter) isNDJSON() bool {
+	return s.dataFormat == internal.FormatNDJSON && s.format().IsJSON()
+}
+
+// extension returns the file extension of the data written, without a dot
+func (s *S3Adapter) extension() string {
+	if s.isNDJSON() {
+		return internal.FormatNDJSON
+	}
+	return s.format().Extension()
+}
+
+// contentType returns the media type of the data written, before compression and encryption
+func (s *S3Adapter) contentType() string {
+	if s.isNDJSON() {
+		return ContentTypeNDJSON
+	}
+	return s.format().ContentType()
+}
+
+// SetDataFormat provides the format of the set's transformed data, so that NDJSON is named and
+// labelled as such
+func (s *S3Adapter) SetDataFormat(format string) {
+	s.dataFormat = format
+}
+
+// SetEncryptionKey enables encryption of the set's data after it is compressed
+func (s *S3Adapter) SetEncryptionKey(key []byte) {
+	s.encryptionKey = key
+}
+
+// SetMetadataSource provides the source's metadata to the Upload templates
+func (s *S3Adapter) SetMetadataSource(source internal.MetadataSource) {
+	s.metadataSource = source
+}
+
+func (s *S3Adapter) saveObject(data io.Reader, fileName string, templateData internal.TemplateData) error {
+	client, err := s.s3Client()
 	if err != nil {
 		return fmt.Errorf("error initializing S3: %s", err)
 	}
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.S3Config.BucketName),
+		Key:         aws.String(fileName),
+		Body:        data,
+		ContentType: aws.String(s.contentType()),
+	}
+	switch {
+	case s.encryptionKey != nil:
+		// The encrypted data can't be read by clients as its format or compression
+		input.ContentType = aws.String(ContentTypeEncrypted)
+	case s.S3Set.Compression != internal.CompressionNone:
+		input.ContentEncoding = aws.String(s.S3Set.Compression)
+	}
+	if err := s.upload.apply(input, templateData); err != nil {
+		return err
+	}
+
+	_, err = s3manager.NewUploaderWithClient(client).Upload(input)
+	if err != nil {
+		return fmt.Errorf("error saving data to %s/%s ... %w", s.S3Config.BucketName, fileName, err)
+	}
+
+	return nil
+}
+
+// LastContentHash returns the content hash recorded in the set's manifest object, or "" if
+// there is no manifest
+func (s *S3Adapter) LastContentHash() (string, error) {
+	client, err := s.s3Client()
+	if err != nil {
+		return "", fmt.Errorf("error initializing S3: %s", err)
+	}
+
+	output, err := client.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(s.S3Config.BucketName),
-		Key:    aws.String(fileName),
-		Body:   bytes.NewReader(data),
+		Key:    aws.String(s.S3Set.ManifestKey),
 	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return "", nil
+	}
 	if err != nil {
-		return fmt.Errorf("error saving data to %s/%s ... %s", s.S3Config.BucketName, fileName, err)
+		return "", fmt.Errorf("error reading %s/%s ... %s", s.S3Config.BucketName, s.S3Set.ManifestKey, err)
 	}
+	defer output.Body.Close()
 
+	var manifest internal.ArchiveManifest
+	if err := json.NewDecoder(output.Body).Decode(&manifest); err != nil {
+		return "", fmt.Errorf("error decoding manifest %s: %s", s.S3Set.ManifestKey, err)
+	}
+	return manifest.ContentHash, nil
+}
+
+// SaveContentHash writes the set's manifest object, recording the hash of the data and the key
+// of the object last written
+func (s *S3Adapter) SaveContentHash(hash string) error {
+	manifest, err := json.Marshal(internal.ArchiveManifest{
+		ContentHash: hash,
+		ObjectKey:   s.lastObjectKey,
+		Updated:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := s.s3Client()
+	if err != nil {
+		return fmt.Errorf("error initializing S3: %s", err)
+	}
+
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.S3Config.BucketName),
+		Key:         aws.String(s.S3Set.ManifestKey),
+		Body:        bytes.NewReader(manifest),
+		ContentType: aws.String(ContentTypeJSON),
+	})
+	if err != nil {
+		return fmt.Errorf("error saving manifest to %s/%s ... %s", s.S3Config.BucketName, s.S3Set.ManifestKey, err)
+	}
 	return nil
 }
 
-func (s *S3Adapter) createS3Uploader() (*s3manager.Uploader, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s.S3Config.AwsConfig.Region),
-		Credentials: credentials.NewStaticCredentials(
-			s.S3Config.AwsConfig.AccessKeyId, s.S3Config.AwsConfig.SecretAccessKey, ""),
+// Prune deletes the set's objects that are not kept by its retention policy. Only objects with
+// keys that match the set's ObjectNamePrefix or ObjectKeyTemplate are considered. In dry-run mode,
+// the objects are only listed. Each deleted object is reported on the event log.
+func (s *S3Adapter) Prune(dryRun bool, eventLog chan<- internal.EventLogItem) error {
+	if s.retention.IsEmpty() {
+		return nil
+	}
+
+	svc, err := s.s3Client()
+	if err != nil {
+		return fmt.Errorf("error initializing S3: %s", err)
+	}
+
+	var objects []internal.ArchivedObject
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.S3Config.BucketName),
+		Prefix: aws.String(s.retentionPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			if !s.retentionKeys.MatchString(aws.StringValue(o.Key)) {
+				continue
+			}
+			objects = append(objects, internal.ArchivedObject{
+				Key:      aws.StringValue(o.Key),
+				Modified: aws.TimeValue(o.LastModified),
+			})
+		}
+		return true
 	})
-	return s3manager.NewUploader(sess), err
+	if err != nil {
+		return fmt.Errorf("error listing objects in %s/%s ... %s", s.S3Config.BucketName, s.retentionPrefix, err)
+	}
+
+	expired := s.retention.Expired(objects, time.Now())
+	if dryRun {
+		for _, key := range expired {
+			eventLog <- internal.EventLogItem{
+				Level:   syslog.LOG_INFO,
+				Message: fmt.Sprintf("dry run: would delete %s from bucket %s (retention policy)", key, s.S3Config.BucketName),
+			}
+		}
+		return nil
+	}
+
+	var failed []string
+	for start := 0; start < len(expired); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(expired) {
+			end = len(expired)
+		}
+
+		ids := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range expired[start:end] {
+			ids = append(ids, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.S3Config.BucketName),
+			Delete: &s3.Delete{Objects: ids, Quiet: aws.Bool(false)},
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting objects from %s ... %s", s.S3Config.BucketName, err)
+		}
+
+		for _, d := range output.Deleted {
+			eventLog <- internal.EventLogItem{
+				Level:   syslog.LOG_INFO,
+				Message: fmt.Sprintf("deleted %s from bucket %s (retention policy)", aws.StringValue(d.Key), s.S3Config.BucketName),
+			}
+		}
+		for _, e := range output.Errors {
+			failed = append(failed, fmt.Sprintf("%s: %s", aws.StringValue(e.Key), aws.StringValue(e.Message)))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to delete %d object(s): %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// s3Client returns the adapter's S3 client, which is shared by all of its sets
+func (s *S3Adapter) s3Client() (*s3.S3, error) {
+	return s.client.get(s.S3Config.S3Endpoint, s.S3Config.AwsConfig)
 }
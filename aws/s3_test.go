@@ -0,0 +1,603 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// fakeS3 is an in-process S3-compatible server that supports the path-style requests made by the
+// S3 destination and state store: PutObject, GetObject, ListObjectsV2 and DeleteObjects
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string]fakeObject
+	clock   time.Time
+}
+
+type fakeObject struct {
+	data            []byte
+	contentType     string
+	contentEncoding string
+	header          http.Header
+	modified        time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: map[string]fakeObject{}, clock: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		data, _ := io.ReadAll(r.Body)
+		// Each object is one second newer than the last, so that retention is deterministic
+		f.clock = f.clock.Add(time.Second)
+		f.objects[bucket+"/"+key] = fakeObject{
+			data:            data,
+			contentType:     r.Header.Get("Content-Type"),
+			contentEncoding: r.Header.Get("Content-Encoding"),
+			header:          r.Header.Clone(),
+			modified:        f.clock,
+		}
+		w.Header().Set("ETag", `"etag"`)
+
+	case r.Method == http.MethodGet && key != "":
+		o, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Message>%s not found</Message></Error>", key)
+			return
+		}
+		w.Header().Set("Content-Type", o.contentType)
+		_, _ = w.Write(o.data)
+
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		type content struct {
+			Key          string
+			LastModified string
+			Size         int
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Name     string
+			Contents []content
+		}
+		result.Name = bucket
+		prefix := bucket + "/" + r.URL.Query().Get("prefix")
+		for _, k := range f.keys() {
+			if strings.HasPrefix(k, prefix) {
+				o := f.objects[k]
+				result.Contents = append(result.Contents, content{
+					Key:          strings.TrimPrefix(k, bucket+"/"),
+					LastModified: o.modified.Format(time.RFC3339),
+					Size:         len(o.data),
+				})
+			}
+		}
+		_ = xml.NewEncoder(w).Encode(result)
+
+	case r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		var request struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		type deleted struct{ Key string }
+		var result struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+			Deleted []deleted
+		}
+		for _, o := range request.Object {
+			delete(f.objects, bucket+"/"+o.Key)
+			result.Deleted = append(result.Deleted, deleted{Key: o.Key})
+		}
+		_ = xml.NewEncoder(w).Encode(result)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// keys returns the sorted keys of the stored objects, each prefixed by the bucket name
+func (f *fakeS3) keys() []string {
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) object(t *testing.T, key string) fakeObject {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	o, ok := f.objects[key]
+	require.True(t, ok, "object %s not found, objects: %v", key, f.keys())
+	return o
+}
+
+func (f *fakeS3) list(prefix string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var keys []string
+	for _, k := range f.keys() {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func testS3Config(serverURL string) S3Config {
+	return S3Config{
+		BucketName: "archive",
+		AwsConfig: Config{
+			Region:          "us-east-1",
+			AccessKeyId:     "test-key",
+			SecretAccessKey: "test-secret",
+		},
+		S3Endpoint: S3Endpoint{Endpoint: serverURL, ForcePathStyle: true},
+	}
+}
+
+func newTestDestination(t *testing.T, config S3Config, setName, setJSON string) internal.Destination {
+	adapterConfig, err := json.Marshal(config)
+	require.NoError(t, err)
+	destination, err := internal.NewDestination(internal.DestinationConfig{
+		Type:          internal.DestinationTypeS3,
+		AdapterConfig: adapterConfig,
+	})
+	require.NoError(t, err)
+
+	setDestination, err := destination.ForSet(setName, json.RawMessage(setJSON))
+	require.NoError(t, err)
+	return setDestination
+}
+
+func TestS3Adapter_WriteStream(t *testing.T) {
+	tests := []struct {
+		name                string
+		setJSON             string
+		wantSuffix          string
+		wantContentType     string
+		wantContentEncoding string
+		want                string
+	}{
+		{
+			name:            "json",
+			setJSON:         `{}`,
+			wantContentType: "application/json",
+			want:            `[{"id":1,"name":"Ann"}]`,
+		},
+		{
+			name:                "gzip",
+			setJSON:             `{"Compression":"gzip"}`,
+			wantSuffix:          ".json.gz",
+			wantContentType:     "application/json",
+			wantContentEncoding: "gzip",
+			want:                `[{"id":1,"name":"Ann"}]`,
+		},
+		{
+			name:                "zstd",
+			setJSON:             `{"Compression":"zstd"}`,
+			wantSuffix:          ".json.zst",
+			wantContentType:     "application/json",
+			wantContentEncoding: "zstd",
+			want:                `[{"id":1,"name":"Ann"}]`,
+		},
+		{
+			name:            "csv",
+			setJSON:         `{"Format":{"Type":"csv"}}`,
+			wantSuffix:      ".csv",
+			wantContentType: "text/csv",
+			want:            "id,name\n1,Ann\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, server := newFakeS3(t)
+			destination := newTestDestination(t, testS3Config(server.URL), "users", tt.setJSON)
+
+			eventLog := make(chan internal.EventLogItem, 10)
+			err := destination.(internal.StreamDestination).WriteStream(strings.NewReader(`[{"id":1,"name":"Ann"}]`), eventLog)
+			require.NoError(t, err)
+
+			keys := fake.list("archive/users/data_")
+			require.Len(t, keys, 1)
+			require.True(t, strings.HasSuffix(keys[0], tt.wantSuffix), "key %s", keys[0])
+
+			o := fake.object(t, keys[0])
+			require.Equal(t, tt.wantContentType, o.contentType)
+			require.Equal(t, tt.wantContentEncoding, o.contentEncoding)
+
+			data, err := internal.Decompress(bytes.NewReader(o.data), tt.wantContentEncoding)
+			require.NoError(t, err)
+			got, err := io.ReadAll(data)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestS3Adapter_SkipIfUnchangedAndRetention(t *testing.T) {
+	fake, server := newFakeS3(t)
+	config := testS3Config(server.URL)
+	config.Retention = internal.RetentionPolicy{KeepLast: 2}
+
+	skip := true
+	set := internal.Set{Name: "users", Destination: json.RawMessage(`{}`), SkipIfUnchanged: &skip}
+	logger := log.New(io.Discard, "", 0)
+
+	run := func(data string) {
+		destination := newTestDestination(t, config, set.Name, string(set.Destination))
+		source := &testSource{data: []byte(data)}
+		require.NoError(t, internal.RunSet(logger, set, source, destination, nil, internal.AppConfig{}))
+	}
+
+	run(`[{"id":1}]`)
+	run(`[{"id":1}]`)
+	require.Len(t, fake.list("archive/users/"), 1, "unchanged data should not be written again")
+
+	run(`[{"id":2}]`)
+	run(`[{"id":3}]`)
+	keys := fake.list("archive/users/")
+	require.Len(t, keys, 2, "the retention policy should keep the last 2 objects")
+	require.Equal(t, `[{"id":3}]`, string(fake.object(t, keys[1]).data))
+
+	var manifest internal.ArchiveManifest
+	require.NoError(t, json.Unmarshal(fake.object(t, "archive/.rda/users.json").data, &manifest))
+	require.Equal(t, strings.TrimPrefix(keys[1], "archive/"), manifest.ObjectKey)
+}
+
+func TestS3Adapter_RetentionWithOverlappingPrefixes(t *testing.T) {
+	tests := []struct {
+		name        string
+		sets        []string
+		setJSON     map[string]string
+		wantPrefix  map[string]string
+		keepPerSet  int
+		objectCount int
+	}{
+		{
+			name: "key template",
+			sets: []string{"hr_payroll", "hr"},
+			setJSON: map[string]string{
+				"hr":         `{"ObjectKeyTemplate":"{set}_{timestamp:RFC3339Nano}.json"}`,
+				"hr_payroll": `{"ObjectKeyTemplate":"{set}_{timestamp:RFC3339Nano}.json"}`,
+			},
+			wantPrefix: map[string]string{"hr": "archive/hr_2", "hr_payroll": "archive/hr_payroll_"},
+		},
+		{
+			name: "object name prefix",
+			sets: []string{"extra", "users"},
+			setJSON: map[string]string{
+				"users": `{"ObjectNamePrefix":"users"}`,
+				"extra": `{"ObjectNamePrefix":"users_extra"}`,
+			},
+			wantPrefix: map[string]string{"users": "archive/users1", "extra": "archive/users_extra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, server := newFakeS3(t)
+			config := testS3Config(server.URL)
+			config.Retention = internal.RetentionPolicy{KeepLast: 1}
+
+			for _, setName := range tt.sets {
+				set := internal.Set{Name: setName}
+				for i := 0; i < 2; i++ {
+					destination := newTestDestination(t, config, setName, tt.setJSON[setName])
+					source := &testSource{data: []byte(`[{"id":1}]`)}
+					require.NoError(t, internal.RunSet(log.New(io.Discard, "", 0), set, source, destination, nil, internal.AppConfig{}))
+				}
+			}
+
+			for _, setName := range tt.sets {
+				require.Len(t, fake.list(tt.wantPrefix[setName]), 1, "set %s should keep its last object, objects: %v",
+					setName, fake.list("archive/"))
+			}
+		})
+	}
+}
+
+func TestS3Adapter_UploadOptions(t *testing.T) {
+	fake, server := newFakeS3(t)
+	config := testS3Config(server.URL)
+	config.Upload = UploadOptions{
+		StorageClass: s3.StorageClassGlacierIr,
+		SSEKMSKeyID:  "alias/archive",
+		Tags:         map[string]string{"set": "{{.SetName}}", "run": "{{.RunID}}", "team": "data"},
+		Metadata:     map[string]string{"records": "{{.Source.RecordCount}}", "sha256": "{{.ContentHash}}"},
+	}
+
+	setJSON := `{"Upload":{"Tags":{"team":"hr"},"ObjectLockMode":"COMPLIANCE","ObjectLockRetainDays":30}}`
+	destination := newTestDestination(t, config, "users", setJSON)
+	destination.(*S3Adapter).DestinationConfig.RunID = "run1"
+
+	set := internal.Set{Name: "users"}
+	source := &testMetadataSource{testSource: testSource{data: []byte(`[{"id":1}]`)}}
+	var logged bytes.Buffer
+	require.NoError(t, internal.RunSet(log.New(&logged, "", 0), set, source, destination, nil, internal.AppConfig{}))
+	require.NotContains(t, logged.String(), "Warning:")
+
+	keys := fake.list("archive/users/")
+	require.Len(t, keys, 1)
+	header := fake.object(t, keys[0]).header
+	require.Equal(t, "GLACIER_IR", header.Get("X-Amz-Storage-Class"))
+	require.Equal(t, "aws:kms", header.Get("X-Amz-Server-Side-Encryption"))
+	require.Equal(t, "alias/archive", header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	require.Equal(t, "run=run1&set=users&team=hr", header.Get("X-Amz-Tagging"))
+	require.Equal(t, "1", header.Get("X-Amz-Meta-Records"))
+	sum := sha256.Sum256([]byte(`[{"id":1}]`))
+	require.Equal(t, hex.EncodeToString(sum[:]), header.Get("X-Amz-Meta-Sha256"))
+	require.Equal(t, "COMPLIANCE", header.Get("X-Amz-Object-Lock-Mode"))
+	until, err := time.Parse(time.RFC3339, header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().AddDate(0, 0, 30), until, time.Minute)
+}
+
+func TestS3Adapter_UploadOptions_NoSourceMetadata(t *testing.T) {
+	fake, server := newFakeS3(t)
+	config := testS3Config(server.URL)
+	config.Upload = UploadOptions{
+		Tags:     map[string]string{"records": "{{.Source.RecordCount}}"},
+		Metadata: map[string]string{"url": "{{.Source.SourceURL | default \"unknown\"}}"},
+	}
+	destination := newTestDestination(t, config, "users", `{}`)
+
+	set := internal.Set{Name: "users"}
+	source := &testSource{data: []byte(`[{"id":1}]`)}
+	var logged bytes.Buffer
+	require.NoError(t, internal.RunSet(log.New(&logged, "", 0), set, source, destination, nil, internal.AppConfig{}))
+	require.Contains(t, logged.String(), "Warning: the Upload templates use .Source.RecordCount, which the source did not report")
+
+	keys := fake.list("archive/users/")
+	require.Len(t, keys, 1)
+	header := fake.object(t, keys[0]).header
+	require.Equal(t, "records=", header.Get("X-Amz-Tagging"))
+	require.Equal(t, "unknown", header.Get("X-Amz-Meta-Url"))
+}
+
+func TestS3Adapter_CompressionNone(t *testing.T) {
+	fake, server := newFakeS3(t)
+	config := testS3Config(server.URL)
+	config.Compression = "none"
+
+	for setName, setJSON := range map[string]string{"users": `{}`, "groups": `{"Compression":"none"}`, "roles": `{"Compression":"gzip"}`} {
+		destination := newTestDestination(t, config, setName, setJSON)
+		source := &testSource{data: []byte(`[{"id":1}]`)}
+		require.NoError(t, internal.RunSet(log.New(io.Discard, "", 0), internal.Set{Name: setName}, source, destination, nil, internal.AppConfig{}))
+	}
+
+	for setName, wantGzip := range map[string]bool{"users": false, "groups": false, "roles": true} {
+		keys := fake.list("archive/" + setName + "/")
+		require.Len(t, keys, 1)
+		require.Equal(t, wantGzip, strings.HasSuffix(keys[0], ".gz"), "key %s", keys[0])
+	}
+}
+
+// failingStreamSource streams the start of its data and then fails, as when a later page of the
+// response can't be read
+type failingStreamSource struct {
+	testSource
+}
+
+func (f *failingStreamSource) ReadStream() (io.ReadCloser, error) {
+	return io.NopCloser(io.MultiReader(bytes.NewReader(f.data), iotest.ErrReader(errors.New("page 2: 500 Internal Server Error")))), nil
+}
+
+func TestS3Adapter_SourceStreamFails(t *testing.T) {
+	fake, server := newFakeS3(t)
+
+	for setName, setJSON := range map[string]string{
+		"json": `{}`,
+		"gzip": `{"Compression":"gzip"}`,
+		"csv":  `{"Format":{"Type":"csv"}}`,
+	} {
+		t.Run(setName, func(t *testing.T) {
+			destination := newTestDestination(t, testS3Config(server.URL), setName, setJSON)
+			source := &failingStreamSource{testSource: testSource{data: []byte(`[{"id":1},`)}}
+
+			var logged bytes.Buffer
+			err := internal.RunSet(log.New(&logged, "", 0), internal.Set{Name: setName}, source, destination, nil, internal.AppConfig{})
+
+			// The error is alerted once, in the summary of the run's errors, as a failure of the source
+			require.Error(t, err)
+			require.False(t, internal.IsAlerted(err))
+			require.Contains(t, err.Error(), "error reading from source: page 2: 500 Internal Server Error")
+			require.NotContains(t, logged.String(), "Alert:")
+			require.NotContains(t, logged.String(), "error saving to S3")
+			require.Empty(t, fake.list("archive/"+setName+"/"))
+		})
+	}
+}
+
+func TestS3Adapter_NDJSON(t *testing.T) {
+	fake, server := newFakeS3(t)
+	config := testS3Config(server.URL)
+	set := internal.Set{Name: "users", Transform: &internal.TransformConfig{Format: internal.FormatNDJSON}}
+	require.NoError(t, set.Transform.Validate())
+
+	for _, setJSON := range []string{`{}`, `{"Compression":"gzip","ObjectKeyTemplate":"{set}/ndjson/{timestamp}.{ext}"}`} {
+		destination := newTestDestination(t, config, "users", setJSON)
+		source := &testSource{data: []byte(`[{"id":1},{"id":2}]`)}
+		require.NoError(t, internal.RunSet(log.New(io.Discard, "", 0), set, source, destination, nil, internal.AppConfig{}))
+	}
+
+	keys := fake.list("archive/users/data_")
+	require.Len(t, keys, 1)
+	require.True(t, strings.HasSuffix(keys[0], ".ndjson"), "key %s", keys[0])
+	o := fake.object(t, keys[0])
+	require.Equal(t, ContentTypeNDJSON, o.contentType)
+	require.Equal(t, "{\"id\":1}\n{\"id\":2}\n", string(o.data))
+
+	keys = fake.list("archive/users/ndjson/")
+	require.Len(t, keys, 1)
+	require.True(t, strings.HasSuffix(keys[0], ".ndjson.gz"), "key %s", keys[0])
+	require.Equal(t, ContentTypeNDJSON, fake.object(t, keys[0]).contentType)
+}
+
+func TestS3Adapter_CompressionAndEncryption(t *testing.T) {
+	fake, server := newFakeS3(t)
+	key := bytes.Repeat([]byte{7}, 32)
+	appConfig := internal.AppConfig{Encryption: internal.EncryptionConfig{
+		Type: internal.EncryptionTypeAESGCM,
+		Key:  base64.StdEncoding.EncodeToString(key),
+	}}
+
+	data := `[` + strings.Repeat(`{"id":1,"name":"Ann"},`, 1000) + `{"id":2}]`
+	destination := newTestDestination(t, testS3Config(server.URL), "users", `{"Compression":"gzip"}`)
+	set := internal.Set{Name: "users"}
+	require.NoError(t, internal.RunSet(log.New(io.Discard, "", 0), set, &testSource{data: []byte(data)}, destination, nil, appConfig))
+
+	keys := fake.list("archive/users/")
+	require.Len(t, keys, 1)
+	require.True(t, strings.HasSuffix(keys[0], ".json.gz"), "key %s", keys[0])
+	o := fake.object(t, keys[0])
+	require.Equal(t, ContentTypeEncrypted, o.contentType)
+	require.Equal(t, "", o.contentEncoding)
+	require.Less(t, len(o.data), len(data)/10, "the data should be compressed before it is encrypted")
+
+	// decrypt, then decompress
+	var decrypted bytes.Buffer
+	require.NoError(t, internal.Decrypt(&decrypted, bytes.NewReader(o.data), key))
+	decompressed, err := internal.Decompress(&decrypted, internal.CompressionGzip)
+	require.NoError(t, err)
+	got, err := io.ReadAll(decompressed)
+	require.NoError(t, err)
+	require.Equal(t, data, string(got))
+}
+
+func TestUploadOptions_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options UploadOptions
+		wantErr string
+	}{
+		{name: "empty", options: UploadOptions{}},
+		{name: "storage class", options: UploadOptions{StorageClass: "DEEP_ARCHIVE"}},
+		{name: "bad storage class", options: UploadOptions{StorageClass: "COLD"}, wantErr: "StorageClass"},
+		{name: "KMS key with AES256", options: UploadOptions{ServerSideEncryption: "AES256", SSEKMSKeyID: "k"}, wantErr: "SSEKMSKeyID"},
+		{name: "retention without mode", options: UploadOptions{ObjectLockRetainDays: 7}, wantErr: "ObjectLockMode is required"},
+		{name: "mode without retention", options: UploadOptions{ObjectLockMode: "GOVERNANCE"}, wantErr: "requires either"},
+		{name: "bad mode", options: UploadOptions{ObjectLockMode: "WORM", ObjectLockRetainDays: 7}, wantErr: "unrecognized ObjectLockMode"},
+		{name: "retain until", options: UploadOptions{ObjectLockMode: "GOVERNANCE", ObjectLockRetainUntil: "2030-01-01T00:00:00Z"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.validate()
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestS3StateStore(t *testing.T) {
+	_, server := newFakeS3(t)
+	config := testS3Config(server.URL)
+	adapterConfig, err := json.Marshal(S3StateStore{
+		AwsConfig:  config.AwsConfig,
+		BucketName: config.BucketName,
+		S3Endpoint: config.S3Endpoint,
+	})
+	require.NoError(t, err)
+
+	store, err := internal.NewStateStore(internal.StateConfig{Type: internal.StateStoreTypeS3, AdapterConfig: adapterConfig})
+	require.NoError(t, err)
+
+	state, err := store.Load("users")
+	require.NoError(t, err)
+	require.True(t, state.LastRunTime.IsZero(), "a set that has not run should have no state")
+
+	lastRun := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	require.NoError(t, store.Save("users", internal.SetState{LastRunTime: lastRun, Watermark: "42"}))
+
+	state, err = store.Load("users")
+	require.NoError(t, err)
+	require.True(t, lastRun.Equal(state.LastRunTime))
+	require.Equal(t, "42", state.Watermark)
+}
+
+type testSource struct {
+	data []byte
+}
+
+func (t *testSource) ForSet(setName string, setJson json.RawMessage) (internal.Source, error) {
+	return t, nil
+}
+
+func (t *testSource) Read() ([]byte, error) {
+	return t.data, nil
+}
+
+type testMetadataSource struct {
+	testSource
+}
+
+func (t *testMetadataSource) SourceMetadata() map[string]string {
+	return map[string]string{"RecordCount": "1"}
+}
+
+func TestS3Adapter_SharesClient(t *testing.T) {
+	_, server := newFakeS3(t)
+	adapterConfig, err := json.Marshal(testS3Config(server.URL))
+	require.NoError(t, err)
+	destination, err := NewS3Destination(internal.DestinationConfig{AdapterConfig: adapterConfig})
+	require.NoError(t, err)
+
+	users, err := destination.ForSet("users", json.RawMessage(`{}`))
+	require.NoError(t, err)
+	groups, err := destination.ForSet("groups", json.RawMessage(`{}`))
+	require.NoError(t, err)
+
+	client, err := users.(*S3Adapter).s3Client()
+	require.NoError(t, err)
+	again, err := users.(*S3Adapter).s3Client()
+	require.NoError(t, err)
+	other, err := groups.(*S3Adapter).s3Client()
+	require.NoError(t, err)
+	require.Same(t, client, again, "the client should be created once")
+	require.Same(t, client, other, "the client should be shared by the sets")
+
+	store, err := NewS3StateStore(internal.StateConfig{AdapterConfig: adapterConfig})
+	require.NoError(t, err)
+	s := store.(*S3StateStore)
+	stateClient, err := s.client.get(s.S3Endpoint, s.AwsConfig)
+	require.NoError(t, err)
+	again, err = s.client.get(s.S3Endpoint, s.AwsConfig)
+	require.NoError(t, err)
+	require.Same(t, stateClient, again)
+}
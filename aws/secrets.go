@@ -0,0 +1,129 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+	"github.com/silinternational/rest-data-archiver/internal/awsutil"
+)
+
+const (
+	SecretSchemeSSM            = "ssm"
+	SecretSchemeSecretsManager = "secretsmanager"
+)
+
+// SSMResolver resolves "ssm:<parameter name>" config values from the AWS Systems Manager
+// Parameter Store. SecureString parameters are decrypted.
+type SSMResolver struct {
+	// NewClient creates the SSM client for the region, which is empty if not known. Default: a
+	// client using the default AWS credential chain.
+	NewClient func(region string) (ssmiface.SSMAPI, error)
+}
+
+// SecretsManagerResolver resolves "secretsmanager:<secret ID>" config values from AWS Secrets
+// Manager. The secret ID is a name or ARN, optionally followed by "#" and the key of a value in
+// a JSON secret, such as "secretsmanager:prod/api#password".
+type SecretsManagerResolver struct {
+	// NewClient creates the Secrets Manager client for the region, which is empty if not known.
+	// Default: a client using the default AWS credential chain.
+	NewClient func(region string) (secretsmanageriface.SecretsManagerAPI, error)
+}
+
+func init() {
+	internal.RegisterSecretResolver(SecretSchemeSSM, &SSMResolver{})
+	internal.RegisterSecretResolver(SecretSchemeSecretsManager, &SecretsManagerResolver{})
+}
+
+// Resolve returns the value of the parameter
+func (r *SSMResolver) Resolve(ref string) (string, error) {
+	newClient := r.NewClient
+	if newClient == nil {
+		newClient = func(region string) (ssmiface.SSMAPI, error) {
+			sess, err := awsutil.NewSession(awsutil.Config{Region: region})
+			if err != nil {
+				return nil, err
+			}
+			return ssm.New(sess), nil
+		}
+	}
+
+	client, err := newClient(arnRegion(ref))
+	if err != nil {
+		return "", fmt.Errorf("error initializing SSM: %s", err)
+	}
+	output, err := client.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(ref),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.Parameter == nil {
+		return "", fmt.Errorf("parameter %s has no value", ref)
+	}
+	return aws.StringValue(output.Parameter.Value), nil
+}
+
+// Resolve returns the value of the secret, or of the key within a JSON secret
+func (r *SecretsManagerResolver) Resolve(ref string) (string, error) {
+	secretID, key, hasKey := strings.Cut(ref, "#")
+
+	newClient := r.NewClient
+	if newClient == nil {
+		newClient = func(region string) (secretsmanageriface.SecretsManagerAPI, error) {
+			sess, err := awsutil.NewSession(awsutil.Config{Region: region})
+			if err != nil {
+				return nil, err
+			}
+			return secretsmanager.New(sess), nil
+		}
+	}
+
+	client, err := newClient(arnRegion(secretID))
+	if err != nil {
+		return "", fmt.Errorf("error initializing Secrets Manager: %s", err)
+	}
+	output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", secretID)
+	}
+	if !hasKey {
+		return *output.SecretString, nil
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(*output.SecretString), &values); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object", secretID)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key '%s'", secretID, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// arnRegion returns the region of the resource if it is identified by an ARN, or ""
+func arnRegion(id string) string {
+	a, err := arn.Parse(id)
+	if err != nil {
+		return ""
+	}
+	return a.Region
+}
@@ -0,0 +1,99 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func (s *stubSSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	if !aws.BoolValue(input.WithDecryption) {
+		return nil, errors.New("parameter must be decrypted")
+	}
+	value, ok := s.parameters[aws.StringValue(input.Name)]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+type stubSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (s *stubSecretsManager) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	value, ok := s.secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func TestSSMResolver(t *testing.T) {
+	var gotRegion string
+	resolver := &SSMResolver{NewClient: func(region string) (ssmiface.SSMAPI, error) {
+		gotRegion = region
+		return &stubSSM{parameters: map[string]string{
+			"/rda/password": "p@ssw0rd",
+			"arn:aws:ssm:eu-west-1:123456789012:parameter/rda/key": "key123",
+		}}, nil
+	}}
+
+	value, err := resolver.Resolve("/rda/password")
+	require.NoError(t, err)
+	require.Equal(t, "p@ssw0rd", value)
+	require.Equal(t, "", gotRegion)
+
+	value, err = resolver.Resolve("arn:aws:ssm:eu-west-1:123456789012:parameter/rda/key")
+	require.NoError(t, err)
+	require.Equal(t, "key123", value)
+	require.Equal(t, "eu-west-1", gotRegion)
+
+	_, err = resolver.Resolve("/rda/missing")
+	require.Error(t, err)
+}
+
+func TestSecretsManagerResolver(t *testing.T) {
+	resolver := &SecretsManagerResolver{NewClient: func(region string) (secretsmanageriface.SecretsManagerAPI, error) {
+		return &stubSecretsManager{secrets: map[string]string{
+			"prod/token": "abcdef",
+			"prod/api":   `{"username":"archiver","password":"s3cret!","port":443}`,
+		}}, nil
+	}}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{ref: "prod/token", want: "abcdef"},
+		{ref: "prod/api#password", want: "s3cret!"},
+		{ref: "prod/api#port", want: "443"},
+		{ref: "prod/api#missing", wantErr: true},
+		{ref: "prod/token#key", wantErr: true},
+		{ref: "prod/missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			value, err := resolver.Resolve(tt.ref)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, value)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+const DefaultStatePrefix = ".rda/state/"
+
+// S3StateStore keeps the state of each set in a JSON object in an S3 bucket
+type S3StateStore struct {
+	AwsConfig  Config
+	BucketName string
+
+	// Endpoint, ForcePathStyle and DisableSSL configure an S3-compatible service other than AWS
+	S3Endpoint
+
+	// Prefix is prepended to the set name to form the key of each state object.
+	// Default: ".rda/state/"
+	Prefix string
+
+	client *sharedS3Client
+}
+
+func init() {
+	internal.RegisterStateStore(internal.StateStoreTypeS3, NewS3StateStore)
+}
+
+func NewS3StateStore(stateConfig internal.StateConfig) (internal.StateStore, error) {
+	var store S3StateStore
+	if err := internal.UnmarshalConfig(stateConfig.AdapterConfig, &store); err != nil {
+		return nil, fmt.Errorf("error reading S3 state config: %s", err)
+	}
+	if store.BucketName == "" {
+		return nil, fmt.Errorf("S3 state config is missing an S3 bucket name")
+	}
+	if err := store.AwsConfig.validate(); err != nil {
+		return nil, err
+	}
+	if store.Prefix == "" {
+		store.Prefix = DefaultStatePrefix
+	}
+	store.client = &sharedS3Client{}
+	return &store, nil
+}
+
+// Load returns the saved state of the set, or a zero SetState if there is none
+func (s *S3StateStore) Load(setName string) (internal.SetState, error) {
+	var state internal.SetState
+	client, err := s.client.get(s.S3Endpoint, s.AwsConfig)
+	if err != nil {
+		return state, fmt.Errorf("error initializing S3: %s", err)
+	}
+
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(s.key(setName)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("error reading %s/%s ... %s", s.BucketName, s.key(setName), err)
+	}
+	defer output.Body.Close()
+
+	if err := json.NewDecoder(output.Body).Decode(&state); err != nil {
+		return state, fmt.Errorf("error decoding state %s: %s", s.key(setName), err)
+	}
+	return state, nil
+}
+
+// Save replaces the saved state of the set
+func (s *S3StateStore) Save(setName string, state internal.SetState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.client.get(s.S3Endpoint, s.AwsConfig)
+	if err != nil {
+		return fmt.Errorf("error initializing S3: %s", err)
+	}
+
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.BucketName),
+		Key:         aws.String(s.key(setName)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(ContentTypeJSON),
+	})
+	if err != nil {
+		return fmt.Errorf("error saving state to %s/%s ... %s", s.BucketName, s.key(setName), err)
+	}
+	return nil
+}
+
+func (s *S3StateStore) key(setName string) string {
+	return s.Prefix + setName + ".json"
+}
@@ -0,0 +1,226 @@
+package aws
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// maxObjectTags is the maximum number of tags on an S3 object
+const maxObjectTags = 10
+
+// sourceValuePattern matches a .Source value in a template, such as ".Source.RecordCount"
+var sourceValuePattern = regexp.MustCompile(`\.Source\.(\w+)`)
+
+// UploadOptions configures the objects written by the S3 destination. Tag and Metadata values, and
+// the ObjectLockRetainUntil date, are templates (see internal.TemplateData), such as
+// "{{.Source.RecordCount}}".
+type UploadOptions struct {
+	// StorageClass is the S3 storage class, such as "STANDARD_IA", "GLACIER_IR" or "DEEP_ARCHIVE"
+	StorageClass string
+
+	// ServerSideEncryption is "AES256", "aws:kms" or "aws:kms:dsse". Default: "aws:kms" if an
+	// SSEKMSKeyID is given, otherwise the bucket's default encryption.
+	ServerSideEncryption string
+
+	// SSEKMSKeyID is the ID or ARN of the KMS key used for "aws:kms" encryption
+	SSEKMSKeyID string
+
+	// Tags are the object tags
+	Tags map[string]string
+
+	// Metadata is the user metadata of the object, stored as "x-amz-meta-" headers
+	Metadata map[string]string
+
+	// ObjectLockMode is "GOVERNANCE" or "COMPLIANCE". The bucket must have Object Lock enabled.
+	ObjectLockMode string
+
+	// ObjectLockRetainDays locks each object for the given number of days after it is written
+	ObjectLockRetainDays int
+
+	// ObjectLockRetainUntil locks each object until the given RFC 3339 date
+	ObjectLockRetainUntil string
+}
+
+// validate checks the options and sets the defaults
+func (u *UploadOptions) validate() error {
+	if u.StorageClass != "" && !contains(s3.StorageClass_Values(), u.StorageClass) {
+		return fmt.Errorf("unrecognized StorageClass '%s', must be one of %v", u.StorageClass, s3.StorageClass_Values())
+	}
+
+	if u.SSEKMSKeyID != "" && u.ServerSideEncryption == "" {
+		u.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	}
+	if u.ServerSideEncryption != "" && !contains(s3.ServerSideEncryption_Values(), u.ServerSideEncryption) {
+		return fmt.Errorf("unrecognized ServerSideEncryption '%s', must be one of %v", u.ServerSideEncryption,
+			s3.ServerSideEncryption_Values())
+	}
+	if u.SSEKMSKeyID != "" && !strings.HasPrefix(u.ServerSideEncryption, s3.ServerSideEncryptionAwsKms) {
+		return fmt.Errorf("an SSEKMSKeyID requires ServerSideEncryption '%s'", s3.ServerSideEncryptionAwsKms)
+	}
+
+	if len(u.Tags) > maxObjectTags {
+		return fmt.Errorf("S3 objects may have no more than %d Tags", maxObjectTags)
+	}
+
+	retain := u.ObjectLockRetainDays != 0 || u.ObjectLockRetainUntil != ""
+	switch {
+	case u.ObjectLockMode == "" && retain:
+		return fmt.Errorf("an ObjectLockMode is required to retain objects")
+	case u.ObjectLockMode == "":
+	case !contains(s3.ObjectLockMode_Values(), u.ObjectLockMode):
+		return fmt.Errorf("unrecognized ObjectLockMode '%s', must be one of %v", u.ObjectLockMode, s3.ObjectLockMode_Values())
+	case u.ObjectLockRetainDays < 0:
+		return fmt.Errorf("ObjectLockRetainDays must not be negative")
+	case (u.ObjectLockRetainDays != 0) == (u.ObjectLockRetainUntil != ""):
+		return fmt.Errorf("ObjectLockMode requires either ObjectLockRetainDays or ObjectLockRetainUntil")
+	}
+	return nil
+}
+
+// merge returns a copy of the options with the non-empty options of the set applied. Tags and
+// Metadata are merged, with the set's values taking precedence.
+func (u UploadOptions) merge(set *UploadOptions) UploadOptions {
+	if set == nil {
+		return u
+	}
+	merged := u
+	if set.StorageClass != "" {
+		merged.StorageClass = set.StorageClass
+	}
+	if set.ServerSideEncryption != "" || set.SSEKMSKeyID != "" {
+		merged.ServerSideEncryption = set.ServerSideEncryption
+		merged.SSEKMSKeyID = set.SSEKMSKeyID
+	}
+	merged.Tags = mergeMaps(u.Tags, set.Tags)
+	merged.Metadata = mergeMaps(u.Metadata, set.Metadata)
+	if set.ObjectLockMode != "" {
+		merged.ObjectLockMode = set.ObjectLockMode
+		merged.ObjectLockRetainDays = set.ObjectLockRetainDays
+		merged.ObjectLockRetainUntil = set.ObjectLockRetainUntil
+	}
+	return merged
+}
+
+// hasTemplates returns true if any of the values are templates, which are rendered once the data
+// has been read
+func (u UploadOptions) hasTemplates() bool {
+	for _, values := range []map[string]string{u.Tags, u.Metadata} {
+		for _, v := range values {
+			if strings.Contains(v, "{{") {
+				return true
+			}
+		}
+	}
+	return strings.Contains(u.ObjectLockRetainUntil, "{{")
+}
+
+// sourceValues returns the sorted names of the .Source values used by the templates
+func (u UploadOptions) sourceValues() []string {
+	templates := []string{u.ObjectLockRetainUntil}
+	for _, values := range []map[string]string{u.Tags, u.Metadata} {
+		for _, v := range values {
+			templates = append(templates, v)
+		}
+	}
+
+	used := map[string]bool{}
+	for _, t := range templates {
+		for _, match := range sourceValuePattern.FindAllStringSubmatch(t, -1) {
+			used[match[1]] = true
+		}
+	}
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apply sets the options on the upload input, rendering the templates with the given data
+func (u UploadOptions) apply(input *s3manager.UploadInput, data internal.TemplateData) error {
+	if u.StorageClass != "" {
+		input.StorageClass = aws.String(u.StorageClass)
+	}
+	if u.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(u.ServerSideEncryption)
+	}
+	if u.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(u.SSEKMSKeyID)
+	}
+
+	if len(u.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range u.Tags {
+			value, err := internal.RenderTemplate(v, data)
+			if err != nil {
+				return fmt.Errorf("error in tag '%s': %s", k, err)
+			}
+			tags.Set(k, value)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if len(u.Metadata) > 0 {
+		input.Metadata = map[string]*string{}
+		for k, v := range u.Metadata {
+			value, err := internal.RenderTemplate(v, data)
+			if err != nil {
+				return fmt.Errorf("error in metadata '%s': %s", k, err)
+			}
+			input.Metadata[k] = aws.String(value)
+		}
+	}
+
+	if u.ObjectLockMode != "" {
+		until := data.Now.AddDate(0, 0, u.ObjectLockRetainDays)
+		if u.ObjectLockRetainUntil != "" {
+			value, err := internal.RenderTemplate(u.ObjectLockRetainUntil, data)
+			if err != nil {
+				return fmt.Errorf("error in ObjectLockRetainUntil: %s", err)
+			}
+			if until, err = time.Parse(time.RFC3339, value); err != nil {
+				return fmt.Errorf("ObjectLockRetainUntil '%s' is not an RFC 3339 date", value)
+			}
+		}
+		input.ObjectLockMode = aws.String(u.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(until.UTC())
+
+		// S3 requires a checksum for objects written with Object Lock
+		input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+	}
+	return nil
+}
+
+func mergeMaps(a, b map[string]string) map[string]string {
+	if len(b) == 0 {
+		return a
+	}
+	merged := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
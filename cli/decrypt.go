@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+const decryptUsage = `Usage: %s decrypt [options] <encrypted file> [<output file>]
+
+Restores an archived object that was encrypted by the archiver to plaintext. The
+output is written to stdout if no output file is given. Objects with a .gz or
+.zst extension are decompressed after decryption.
+
+Options:
+`
+
+// decrypt implements the "decrypt" command and returns the process exit code
+func decrypt(args []string) int {
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), decryptUsage, filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	key := flags.String("key", "", "base64-encoded encryption key")
+	keyFile := flags.String("key-file", "", "path to a file containing the base64-encoded encryption key")
+	compression := flags.String("compression", "", `compression of the encrypted file, "gzip" or "zstd" (default: from the file extension)`)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := decryptFile(flags.Arg(0), flags.Arg(1), *compression, internal.EncryptionConfig{
+		Type:    internal.EncryptionTypeAESGCM,
+		Key:     *key,
+		KeyFile: *keyFile,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, "decrypt failed:", err)
+		return 1
+	}
+	return 0
+}
+
+func decryptFile(inputFile, outputFile, compression string, config internal.EncryptionConfig) error {
+	key, err := internal.LoadEncryptionKey(config)
+	if err != nil {
+		return err
+	}
+
+	if compression == "" {
+		switch {
+		case strings.HasSuffix(inputFile, internal.CompressionExtension(internal.CompressionGzip)):
+			compression = internal.CompressionGzip
+		case strings.HasSuffix(inputFile, internal.CompressionExtension(internal.CompressionZstd)):
+			compression = internal.CompressionZstd
+		}
+	}
+
+	in, err := os.Open(inputFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if outputFile == "" {
+		return decryptTo(os.Stdout, in, key, compression)
+	}
+
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// don't leave partially decrypted data behind
+	if err := decryptTo(out, in, key, compression); err != nil {
+		_ = out.Close()
+		_ = os.Remove(outputFile)
+		return err
+	}
+	return out.Close()
+}
+
+// decryptTo decrypts the data from src and then decompresses it, as it was compressed before it
+// was encrypted, writing the result to dst
+func decryptTo(dst io.Writer, src io.Reader, key []byte, compression string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(internal.Decrypt(pw, src, key))
+	}()
+	defer pr.Close()
+
+	decompressed, err := internal.Decompress(pr, compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	_, err = io.Copy(dst, decompressed)
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+func Test_decryptFile(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	config := internal.EncryptionConfig{Type: internal.EncryptionTypeAESGCM, Key: base64.StdEncoding.EncodeToString(key)}
+	data := strings.Repeat(`{"id":1}`, 100)
+
+	for _, compression := range []string{internal.CompressionNone, internal.CompressionGzip, internal.CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			// compressed, then encrypted, as written by the S3 destination
+			compressed, err := internal.Compress(strings.NewReader(data), compression)
+			require.NoError(t, err)
+			encrypted, err := internal.Encrypt(compressed, key)
+			require.NoError(t, err)
+			archived, err := io.ReadAll(encrypted)
+			require.NoError(t, err)
+
+			dir := t.TempDir()
+			inputFile := filepath.Join(dir, "data_1"+internal.CompressionExtension(compression))
+			require.NoError(t, os.WriteFile(inputFile, archived, 0o600))
+			outputFile := filepath.Join(dir, "data.json")
+
+			require.NoError(t, decryptFile(inputFile, outputFile, "", config))
+			got, err := os.ReadFile(outputFile)
+			require.NoError(t, err)
+			require.Equal(t, data, string(got))
+		})
+	}
+}
@@ -7,6 +7,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(decrypt(os.Args[2:]))
+	}
+
 	configFile := ""
 	if len(os.Args) > 1 {
 		configFile = os.Args[1]
@@ -0,0 +1,225 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+const (
+	DefaultObjectNamePrefix = "data_"
+	DefaultManifestDir      = ".rda"
+	DefaultFileMode         = 0o644
+	DefaultDirMode          = 0o755
+)
+
+type FileAdapter struct {
+	// DestinationConfig contains configuration common to all adapters
+	DestinationConfig internal.DestinationConfig
+
+	// FileConfig contains configuration specific to this adapter
+	FileConfig FileConfig
+
+	// FileSet contains configuration that differs for each archive set
+	FileSet FileSet
+
+	setName      string
+	lastFilename string
+}
+
+type FileConfig struct {
+	// RootDirectory is the directory under which all files are written
+	RootDirectory string
+
+	// DateDirectories adds year/month/day directories (UTC) between the directory part of the
+	// ObjectNamePrefix and the file name, e.g. "users/2006/01/02/data_1136214245000000000"
+	DateDirectories bool
+}
+
+type FileSet struct {
+	// ObjectNamePrefix is the file path relative to RootDirectory, excluding the timestamp
+	// suffix. It follows the same convention as the S3 destination. Default: "<set name>/data_"
+	ObjectNamePrefix string `json:"ObjectNamePrefix"`
+}
+
+func init() {
+	internal.RegisterDestination(internal.DestinationTypeFile, NewFileDestination)
+}
+
+func NewFileDestination(destinationConfig internal.DestinationConfig) (internal.Destination, error) {
+	f, err := readConfig(destinationConfig.AdapterConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error reading File destination config: %s", err)
+	}
+
+	f.DestinationConfig = destinationConfig
+
+	return &f, nil
+}
+
+func readConfig(data []byte) (FileAdapter, error) {
+	var f FileAdapter
+
+	err := internal.UnmarshalConfig(data, &f.FileConfig)
+	if err != nil {
+		return f, fmt.Errorf("error unmarshaling FileConfig: %s", err)
+	}
+
+	if f.FileConfig.RootDirectory == "" {
+		return f, fmt.Errorf("config is missing a root directory")
+	}
+
+	return f, nil
+}
+
+// ForSet returns a copy of this FileAdapter configured for the given set
+func (f *FileAdapter) ForSet(setName string, setConfigJson json.RawMessage) (internal.Destination, error) {
+	var setConfig FileSet
+	err := internal.UnmarshalConfig(setConfigJson, &setConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	setAdapter := *f
+	setAdapter.FileSet = setConfig
+	setAdapter.setName = setName
+
+	// Defaults
+	if setAdapter.FileSet.ObjectNamePrefix == "" {
+		setAdapter.FileSet.ObjectNamePrefix = setName + "/" + DefaultObjectNamePrefix
+	}
+
+	if err := checkLocalPath(setName + ".json"); err != nil {
+		return nil, fmt.Errorf("bad set name '%s': %s", setName, err)
+	}
+	if err := checkLocalPath(setAdapter.FileSet.ObjectNamePrefix); err != nil {
+		return nil, fmt.Errorf("bad ObjectNamePrefix in set '%s': %s", setName, err)
+	}
+
+	return &setAdapter, nil
+}
+
+// checkLocalPath returns an error if the slash-separated path, once joined to a root directory,
+// would not stay under it
+func checkLocalPath(name string) error {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("%q must be a relative path that stays within the directory", name)
+	}
+	return nil
+}
+
+func (f *FileAdapter) Write(data []byte, eventLog chan<- internal.EventLogItem) error {
+	return f.WriteStream(bytes.NewReader(data), eventLog)
+}
+
+// WriteStream writes the data to a temporary file and renames it into place once complete, so
+// that a partially written file is never visible under its final name
+func (f *FileAdapter) WriteStream(data io.Reader, eventLog chan<- internal.EventLogItem) error {
+	filename := f.filePath(time.Now())
+	if err := saveFile(data, filename); err != nil {
+		// A failure of the source is reported by RunSet
+		if internal.IsSourceReadError(err) {
+			return err
+		}
+		eventLog <- internal.EventLogItem{
+			Level:   syslog.LOG_ALERT,
+			Message: fmt.Sprintf("error saving to file: %s", err),
+		}
+		return err
+	}
+	f.lastFilename = filename
+	eventLog <- internal.EventLogItem{
+		Level:   syslog.LOG_INFO,
+		Message: fmt.Sprintf("saved to %s", filename),
+	}
+	return nil
+}
+
+// LastContentHash returns the content hash recorded in the set's manifest file, or "" if there
+// is no manifest
+func (f *FileAdapter) LastContentHash() (string, error) {
+	data, err := os.ReadFile(f.manifestPath())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var manifest internal.ArchiveManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("error decoding manifest %s: %s", f.manifestPath(), err)
+	}
+	return manifest.ContentHash, nil
+}
+
+// SaveContentHash writes the set's manifest file, recording the hash of the data and the name of
+// the file last written
+func (f *FileAdapter) SaveContentHash(hash string) error {
+	manifest, err := json.Marshal(internal.ArchiveManifest{
+		ContentHash: hash,
+		ObjectKey:   f.lastFilename,
+		Updated:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return saveFile(bytes.NewReader(manifest), f.manifestPath())
+}
+
+// manifestPath returns the path of the set's manifest file, which is kept in a directory apart
+// from the archived files
+func (f *FileAdapter) manifestPath() string {
+	return filepath.Join(f.FileConfig.RootDirectory, DefaultManifestDir, f.setName+".json")
+}
+
+func (f *FileAdapter) filePath(now time.Time) string {
+	dir, name := path.Split(f.FileSet.ObjectNamePrefix)
+	if f.FileConfig.DateDirectories {
+		now := now.UTC()
+		dir = path.Join(dir, now.Format("2006"), now.Format("01"), now.Format("02"))
+	}
+	name = fmt.Sprintf("%s%v", name, now.UnixNano())
+	return filepath.Join(f.FileConfig.RootDirectory, filepath.FromSlash(dir), name)
+}
+
+func saveFile(data io.Reader, filename string) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, DefaultDirMode); err != nil {
+		return fmt.Errorf("error creating directory %s: %s", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file in %s: %s", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing data to %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error syncing %s: %s", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %s", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFileMode); err != nil {
+		return fmt.Errorf("error setting permissions on %s: %s", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %s", tmp.Name(), filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+func TestFileAdapter_WriteStream(t *testing.T) {
+	tests := []struct {
+		name            string
+		dateDirectories bool
+		setJSON         string
+		wantDir         string
+		wantPrefix      string
+	}{
+		{
+			name:       "default prefix",
+			setJSON:    `{}`,
+			wantDir:    "users",
+			wantPrefix: "data_",
+		},
+		{
+			name:       "custom prefix",
+			setJSON:    `{"ObjectNamePrefix":"archive/users_"}`,
+			wantDir:    "archive",
+			wantPrefix: "users_",
+		},
+		{
+			name:            "date directories",
+			dateDirectories: true,
+			setJSON:         `{}`,
+			wantDir:         filepath.Join("users", time.Now().UTC().Format("2006/01/02")),
+			wantPrefix:      "data_",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			config, _ := json.Marshal(FileConfig{RootDirectory: root, DateDirectories: tt.dateDirectories})
+			destination, err := NewFileDestination(internal.DestinationConfig{AdapterConfig: config})
+			require.NoError(t, err)
+
+			setDestination, err := destination.ForSet("users", json.RawMessage(tt.setJSON))
+			require.NoError(t, err)
+
+			eventLog := make(chan internal.EventLogItem, 10)
+			err = setDestination.(internal.StreamDestination).WriteStream(strings.NewReader(`[{"id":1}]`), eventLog)
+			require.NoError(t, err)
+
+			entries, err := os.ReadDir(filepath.Join(root, tt.wantDir))
+			require.NoError(t, err)
+			require.Len(t, entries, 1, "temporary file was not removed")
+			require.True(t, strings.HasPrefix(entries[0].Name(), tt.wantPrefix))
+
+			data, err := os.ReadFile(filepath.Join(root, tt.wantDir, entries[0].Name()))
+			require.NoError(t, err)
+			require.Equal(t, `[{"id":1}]`, string(data))
+		})
+	}
+}
+
+func TestFileAdapter_WriteStream_SourceFails(t *testing.T) {
+	root := t.TempDir()
+	config, _ := json.Marshal(FileConfig{RootDirectory: root})
+	destination, err := NewFileDestination(internal.DestinationConfig{AdapterConfig: config})
+	require.NoError(t, err)
+	setDestination, err := destination.ForSet("users", json.RawMessage(`{}`))
+	require.NoError(t, err)
+
+	data := iotest.ErrReader(&internal.SourceReadError{Err: errors.New("page 2: 500 Internal Server Error")})
+	eventLog := make(chan internal.EventLogItem, 10)
+	err = setDestination.(internal.StreamDestination).WriteStream(data, eventLog)
+	require.Error(t, err)
+	require.True(t, internal.IsSourceReadError(err))
+	require.Empty(t, eventLog, "a failure of the source should be reported by RunSet, not the destination")
+}
+
+func TestNewFileDestination(t *testing.T) {
+	_, err := NewFileDestination(internal.DestinationConfig{AdapterConfig: []byte(`{}`)})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing a root directory")
+}
+
+func TestFileAdapter_ForSet_Paths(t *testing.T) {
+	config := json.RawMessage(`{"RootDirectory":"` + filepath.ToSlash(t.TempDir()) + `"}`)
+	destination, err := NewFileDestination(internal.DestinationConfig{AdapterConfig: config})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		setName string
+		setJSON string
+		wantErr string
+	}{
+		{name: "default prefix", setName: "users", setJSON: `{}`},
+		{name: "nested prefix", setName: "users", setJSON: `{"ObjectNamePrefix":"a/../b/data_"}`},
+		{name: "set name leaves root", setName: "../users", setJSON: `{"ObjectNamePrefix":"users/data_"}`, wantErr: "bad set name"},
+		{name: "prefix leaves root", setName: "users", setJSON: `{"ObjectNamePrefix":"../../etc/data_"}`, wantErr: "bad ObjectNamePrefix"},
+		{name: "absolute prefix", setName: "users", setJSON: `{"ObjectNamePrefix":"/etc/data_"}`, wantErr: "bad ObjectNamePrefix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := destination.ForSet(tt.setName, json.RawMessage(tt.setJSON))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestFileAdapter_SkipIfUnchanged(t *testing.T) {
+	root := t.TempDir()
+	config, _ := json.Marshal(FileConfig{RootDirectory: root})
+	destination, err := NewFileDestination(internal.DestinationConfig{AdapterConfig: config})
+	require.NoError(t, err)
+
+	skip := true
+	set := internal.Set{Name: "users", Destination: json.RawMessage(`{}`), SkipIfUnchanged: &skip}
+	logger := log.New(io.Discard, "", 0)
+
+	run := func(data string) {
+		setDestination, err := destination.ForSet(set.Name, set.Destination)
+		require.NoError(t, err)
+		source := &testSource{data: []byte(data)}
+		require.NoError(t, internal.RunSet(logger, set, source, setDestination, nil, internal.AppConfig{}))
+	}
+
+	run(`[{"id":1}]`)
+	run(`[{"id":1}]`)
+	entries, err := os.ReadDir(filepath.Join(root, "users"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "unchanged data should not be written again")
+
+	run(`[{"id":2}]`)
+	entries, err = os.ReadDir(filepath.Join(root, "users"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "changed data should be written")
+
+	manifest, err := os.ReadFile(filepath.Join(root, DefaultManifestDir, "users.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), entries[1].Name())
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := internal.NewStateStore(internal.StateConfig{
+		Type:          internal.StateStoreTypeFile,
+		AdapterConfig: json.RawMessage(`{"Directory":"` + filepath.ToSlash(dir) + `"}`),
+	})
+	require.NoError(t, err)
+
+	state, err := store.Load("users")
+	require.NoError(t, err)
+	require.True(t, state.LastRunTime.IsZero(), "a set that has not run should have no state")
+
+	lastRun := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	require.NoError(t, store.Save("users", internal.SetState{LastRunTime: lastRun}))
+
+	state, err = store.Load("users")
+	require.NoError(t, err)
+	require.True(t, lastRun.Equal(state.LastRunTime))
+
+	_, err = store.Load("../users")
+	require.Error(t, err)
+	require.Error(t, store.Save("../users", internal.SetState{LastRunTime: lastRun}))
+	_, err = os.Stat(filepath.Join(dir, "..", "users.json"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = NewFileStateStore(internal.StateConfig{AdapterConfig: json.RawMessage(`{}`)})
+	require.Error(t, err)
+}
+
+type testSource struct {
+	data []byte
+}
+
+func (t *testSource) ForSet(setName string, setJson json.RawMessage) (internal.Source, error) {
+	return t, nil
+}
+
+func (t *testSource) Read() ([]byte, error) {
+	return t.data, nil
+}
@@ -0,0 +1,67 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// FileStateStore keeps the state of each set in a JSON file in a local directory
+type FileStateStore struct {
+	// Directory is the directory in which the state files are kept
+	Directory string
+}
+
+func init() {
+	internal.RegisterStateStore(internal.StateStoreTypeFile, NewFileStateStore)
+}
+
+func NewFileStateStore(stateConfig internal.StateConfig) (internal.StateStore, error) {
+	var store FileStateStore
+	if err := internal.UnmarshalConfig(stateConfig.AdapterConfig, &store); err != nil {
+		return nil, fmt.Errorf("error reading File state config: %s", err)
+	}
+	if store.Directory == "" {
+		return nil, fmt.Errorf("File state config is missing a Directory")
+	}
+	return &store, nil
+}
+
+// Load returns the saved state of the set, or a zero SetState if there is none
+func (s *FileStateStore) Load(setName string) (internal.SetState, error) {
+	var state internal.SetState
+	if err := checkLocalPath(setName + ".json"); err != nil {
+		return state, fmt.Errorf("bad set name '%s': %s", setName, err)
+	}
+	data, err := os.ReadFile(s.path(setName))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error reading state file %s: %s", s.path(setName), err)
+	}
+	return state, nil
+}
+
+// Save replaces the saved state of the set
+func (s *FileStateStore) Save(setName string, state internal.SetState) error {
+	if err := checkLocalPath(setName + ".json"); err != nil {
+		return fmt.Errorf("bad set name '%s': %s", setName, err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return saveFile(bytes.NewReader(data), s.path(setName))
+}
+
+func (s *FileStateStore) path(setName string) string {
+	return filepath.Join(s.Directory, setName+".json")
+}
@@ -0,0 +1,80 @@
+// Package awsutil creates the AWS sessions used by the S3 adapters and the email alerts
+package awsutil
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// RoleSessionName identifies the sessions of assumed roles, for example in CloudTrail
+const RoleSessionName = "rest-data-archiver"
+
+// Config holds the settings of an AWS session
+type Config struct {
+	// Region is the AWS region. If empty, the region is taken from the environment.
+	Region string
+
+	// AccessKeyID and SecretAccessKey are static credentials. If both are empty, the default
+	// credential chain is used: the environment, the shared credentials file, or the IAM role
+	// of the Lambda function, container or instance.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// RoleARN is a role to assume using the credentials above, for example to write to a bucket
+	// in another account
+	RoleARN string
+
+	// ExternalID is passed when assuming the role, if the role's trust policy requires it
+	ExternalID string
+}
+
+// Validate checks that the credentials are complete
+func (c Config) Validate() error {
+	if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+		return errors.New("an AWS access key ID and secret access key must be given together, or neither to use " +
+			"the default credentials")
+	}
+	if c.ExternalID != "" && c.RoleARN == "" {
+		return errors.New("an AWS ExternalID requires a RoleARN")
+	}
+	return nil
+}
+
+// NewSession returns a session using the static credentials if given, or the default credential
+// chain otherwise, and assuming the role if a RoleARN is given
+func NewSession(c Config) (*session.Session, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	config := aws.Config{}
+	if c.Region != "" {
+		config.Region = aws.String(c.Region)
+	}
+	if c.AccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.RoleARN == "" {
+		return sess, nil
+	}
+	roleCredentials := stscreds.NewCredentials(sess, c.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = RoleSessionName
+		if c.ExternalID != "" {
+			p.ExternalID = aws.String(c.ExternalID)
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: roleCredentials}), nil
+}
@@ -0,0 +1,52 @@
+package awsutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "default credentials", config: Config{Region: "us-east-1"}},
+		{name: "static credentials", config: Config{AccessKeyID: "AKID", SecretAccessKey: "secret"}},
+		{name: "role", config: Config{RoleARN: "arn:aws:iam::123456789012:role/archiver", ExternalID: "x"}},
+		{name: "missing secret key", config: Config{AccessKeyID: "AKID"}, wantErr: true},
+		{name: "external ID without role", config: Config{ExternalID: "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	sess, err := NewSession(Config{Region: "eu-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, "eu-west-1", *sess.Config.Region)
+	creds, err := sess.Config.Credentials.Get()
+	require.NoError(t, err)
+	require.Equal(t, "AKID", creds.AccessKeyID)
+
+	role, err := NewSession(Config{
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		RoleARN:         "arn:aws:iam::123456789012:role/archiver",
+	})
+	require.NoError(t, err)
+	require.NotSame(t, sess.Config.Credentials, role.Config.Credentials, "the role's credentials should be used")
+
+	_, err = NewSession(Config{AccessKeyID: "AKID"})
+	require.Error(t, err)
+}
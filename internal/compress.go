@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ValidateCompression returns an error if the compression type is not supported
+func ValidateCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unrecognized compression type '%s', must be '%s' or '%s'",
+		compression, CompressionGzip, CompressionZstd)
+}
+
+// CompressionExtension returns the file name extension, including the leading ".", for the
+// compression type
+func CompressionExtension(compression string) string {
+	switch compression {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// Compress returns a reader that provides the compressed contents of data. The data is
+// compressed as it is read. The caller must close the returned reader.
+func Compress(data io.Reader, compression string) (io.ReadCloser, error) {
+	if err := ValidateCompression(compression); err != nil {
+		return nil, err
+	}
+	if compression == CompressionNone {
+		return io.NopCloser(data), nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(compressTo(pw, data, compression))
+	}()
+	return pr, nil
+}
+
+func compressTo(w io.Writer, data io.Reader, compression string) error {
+	var cw io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		cw = gzip.NewWriter(w)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		cw = zw
+	}
+
+	if _, err := io.Copy(cw, data); err != nil {
+		_ = cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// Decompress returns a reader that provides the decompressed contents of data
+func Decompress(data io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(data), nil
+	case CompressionGzip:
+		return gzip.NewReader(data)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(data)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, ValidateCompression(compression)
+}
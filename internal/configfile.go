@@ -0,0 +1,438 @@
+package internal
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvOverlayPrefix is the prefix of the environment variables that override config values
+const EnvOverlayPrefix = "RDA_"
+
+// decodeConfigFile decodes the config data according to the file extension: ".yaml" or ".yml"
+// for YAML, ".jsonc" for JSON with comments and trailing commas, and JSON otherwise
+func decodeConfigFile(configFile string, data []byte) (interface{}, error) {
+	var doc interface{}
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		return yamlNodeValue(&node)
+	case ".jsonc":
+		data = stripJSONComments(data)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the config object")
+	}
+	return doc, nil
+}
+
+// yamlNodeValue converts a YAML node to the values that a JSON decoder would produce. Keys must
+// be strings. Scalars other than numbers, booleans and nulls, such as dates, are kept as the
+// literal string from the file.
+func yamlNodeValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlNodeValue(node.Alias)
+	case yaml.SequenceNode:
+		values := make([]interface{}, len(node.Content))
+		for i, child := range node.Content {
+			value, err := yamlNodeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	case yaml.MappingNode:
+		values := map[string]interface{}{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, child := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode || key.ShortTag() == "!!merge" {
+				return nil, fmt.Errorf("line %d: config keys must be strings", key.Line)
+			}
+			value, err := yamlNodeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			values[key.Value] = value
+		}
+		return values, nil
+	case yaml.ScalarNode:
+		return yamlScalarValue(node)
+	}
+	return nil, fmt.Errorf("line %d: unsupported YAML value", node.Line)
+}
+
+// yamlScalarValue converts a YAML scalar to a json.Number, bool, nil or string. Numbers and
+// booleans are read into string fields, and numbers with leading zeros into number fields, by
+// UnmarshalConfig.
+func yamlScalarValue(node *yaml.Node) (interface{}, error) {
+	switch node.ShortTag() {
+	case "!!int":
+		var i int64
+		if err := node.Decode(&i); err != nil {
+			return nil, fmt.Errorf("line %d: %s", node.Line, err)
+		}
+		return yamlNumber(node.Value, strconv.FormatInt(i, 10)), nil
+	case "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return nil, fmt.Errorf("line %d: %s", node.Line, err)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("line %d: unsupported number %s", node.Line, node.Value)
+		}
+		return yamlNumber(node.Value, strconv.FormatFloat(f, 'g', -1, 64)), nil
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return nil, fmt.Errorf("line %d: %s", node.Line, err)
+		}
+		return b, nil
+	case "!!null":
+		return nil, nil
+	}
+	return node.Value, nil
+}
+
+// yamlNumber returns the number as it is written in the file if that is a plain decimal JSON
+// number, so that it is kept exactly if it is read into a string, and otherwise as formatted.
+// Decimal integers with leading zeros, such as account IDs, are kept as the literal string.
+func yamlNumber(literal, formatted string) interface{} {
+	digits := strings.TrimPrefix(literal, "-")
+	if strings.Trim(literal, "-0123456789.") == "" && json.Valid([]byte(literal)) {
+		return json.Number(literal)
+	}
+	if digits != "" && strings.Trim(digits, "0123456789") == "" {
+		return literal
+	}
+	return json.Number(formatted)
+}
+
+// stripJSONComments removes "//" and "/* */" comments, and commas before a closing bracket, from
+// JSON data
+func stripJSONComments(data []byte) []byte {
+	var out bytes.Buffer
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out.WriteByte(c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out.WriteByte(data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			out.WriteByte('\n')
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(data)
+			} else {
+				i += end + 3
+			}
+			out.WriteByte(' ')
+		case c == ',' && closesAfterComma(data[i+1:]):
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.Bytes()
+}
+
+// closesAfterComma returns true if the next token in the data, ignoring whitespace and comments,
+// is a closing bracket, so that a preceding comma is a trailing comma
+func closesAfterComma(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+		case '/':
+			if i+1 < len(data) && data[i+1] == '/' {
+				for i < len(data) && data[i] != '\n' {
+					i++
+				}
+			} else if i+1 < len(data) && data[i+1] == '*' {
+				end := bytes.Index(data[i+2:], []byte("*/"))
+				if end < 0 {
+					return false
+				}
+				i += end + 3
+			} else {
+				return false
+			}
+		case '}', ']':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// applyEnvOverlay overrides values in the decoded config with the environment variables that
+// begin with EnvOverlayPrefix. The rest of the variable name is the path to the value, with
+// underscores between the keys, such as RDA_SOURCE_ADAPTERCONFIG_BASEURL. Keys are matched
+// without regard to case, and an element of Sets may be given by its index or its Name, such as
+// RDA_SETS_USERS_SOURCE_PATH. The value replaces a string as it is, and is otherwise decoded as
+// JSON if possible, such as "true" or "10". It returns the names of the variables applied.
+func applyEnvOverlay(doc interface{}, environ []string) (interface{}, []string, error) {
+	// Apply the variables in order, so that the result doesn't depend on the environment's order
+	sort.Strings(environ)
+
+	var applied []string
+	for _, env := range environ {
+		name, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(name, EnvOverlayPrefix) || len(name) == len(EnvOverlayPrefix) {
+			continue
+		}
+		path := strings.Split(name[len(EnvOverlayPrefix):], "_")
+
+		var err error
+		if doc, err = overlayValue(doc, path, value); err != nil {
+			return nil, nil, fmt.Errorf("unable to apply environment variable %s: %s", name, err)
+		}
+		applied = append(applied, name)
+	}
+	return doc, applied, nil
+}
+
+// overlayValue sets the value at the path within doc, creating objects as needed, and returns
+// the updated doc
+func overlayValue(doc interface{}, path []string, value string) (interface{}, error) {
+	if len(path) == 0 {
+		return envValue(doc, value), nil
+	}
+
+	switch node := doc.(type) {
+	case nil:
+		return overlayValue(map[string]interface{}{}, path, value)
+
+	case map[string]interface{}:
+		// Keys may contain underscores, so try the longest matching key first
+		for n := len(path); n > 0; n-- {
+			segment := strings.Join(path[:n], "_")
+			for key, child := range node {
+				if strings.EqualFold(key, segment) {
+					updated, err := overlayValue(child, path[n:], value)
+					if err != nil {
+						return nil, err
+					}
+					node[key] = updated
+					return node, nil
+				}
+			}
+		}
+		updated, err := overlayValue(nil, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = updated
+		return node, nil
+
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("index %d is out of range, there are %d elements", i, len(node))
+			}
+			updated, err := overlayValue(node[i], path[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = updated
+			return node, nil
+		}
+
+		for n := len(path); n > 0; n-- {
+			name := strings.Join(path[:n], "_")
+			for i, element := range node {
+				if elementName, ok := lookupKey(element, "Name").(string); ok && strings.EqualFold(elementName, name) {
+					updated, err := overlayValue(element, path[n:], value)
+					if err != nil {
+						return nil, err
+					}
+					node[i] = updated
+					return node, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("no element named '%s'", path[0])
+	}
+
+	return nil, fmt.Errorf("'%s' is not an object", path[0])
+}
+
+// lookupKey returns the value of the key in the object, without regard to case, or nil
+func lookupKey(object interface{}, key string) interface{} {
+	m, _ := object.(map[string]interface{})
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+// envValue returns the value of an environment variable that replaces the current value. Strings
+// are replaced as they are. Other values are decoded as JSON if possible.
+func envValue(current interface{}, value string) interface{} {
+	if _, isString := current.(string); isString {
+		return value
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil || decoder.More() {
+		return value
+	}
+	return decoded
+}
+
+// UnmarshalConfig unmarshals JSON config data into v like json.Unmarshal, but also reads numbers
+// and booleans into string fields, as their text, and decimal strings into number fields. This
+// accepts an unquoted YAML value, or an environment override, such as a numeric password or
+// account ID. The built-in adapters use it to read their config, and it is exported from the root
+// package for custom adapters.
+func UnmarshalConfig(data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if decodeErr := decoder.Decode(&doc); decodeErr != nil {
+		return err
+	}
+	if data, err = json.Marshal(convertScalars(doc, reflect.TypeOf(v))); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// convertScalars converts the numbers and booleans in the decoded JSON value to strings where
+// json.Unmarshal would read them into a string of type t, and decimal strings to numbers where it
+// would read them into a number
+func convertScalars(value interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return value
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		switch v := value.(type) {
+		case json.Number:
+			return string(v)
+		case bool:
+			return strconv.FormatBool(v)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if v, ok := value.(string); ok && v != "" && strings.Trim(v, "-0123456789.") == "" {
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return json.Number(strconv.FormatInt(i, 10))
+			}
+			if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(f, 0) {
+				return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+			}
+		}
+	case reflect.Struct:
+		if object, ok := value.(map[string]interface{}); ok {
+			for key, child := range object {
+				if field, ok := jsonField(t, key); ok {
+					object[key] = convertScalars(child, field.Type)
+				}
+			}
+		}
+	case reflect.Map:
+		if object, ok := value.(map[string]interface{}); ok {
+			for key, child := range object {
+				object[key] = convertScalars(child, t.Elem())
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if array, ok := value.([]interface{}); ok {
+			for i, child := range array {
+				array[i] = convertScalars(child, t.Elem())
+			}
+		}
+	}
+	return value
+}
+
+// jsonField returns the field of the struct type that json.Unmarshal would set for the key,
+// including the fields of embedded structs
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		if name == "" {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if field.Anonymous && fieldType.Kind() == reflect.Struct {
+				embedded = append(embedded, fieldType)
+				continue
+			}
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	for _, e := range embedded {
+		if field, ok := jsonField(e, key); ok {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	EncryptionTypeAESGCM = "AES-GCM"
+
+	// encryptionChunkSize is the size of each independently authenticated plaintext chunk
+	encryptionChunkSize = 64 * 1024
+
+	encryptionKeySize     = 32
+	encryptionNonceSize   = 12
+	encryptionPrefixSize  = 7
+	encryptionTagSize     = 16
+	encryptionWrappedSize = encryptionKeySize + encryptionTagSize
+)
+
+// encryptionMagic identifies data written by Encrypt and the version of the format
+var encryptionMagic = []byte("RDAE\x01")
+
+// EncryptionConfig configures client-side envelope encryption of archived data. Each archive is
+// encrypted with a random data key, which is itself encrypted ("wrapped") with the configured
+// key and stored in the archive header.
+type EncryptionConfig struct {
+	// Type is the encryption type. The only supported type is "AES-GCM".
+	Type string
+
+	// Key is the base64-encoded 256-bit key used to wrap data keys
+	Key string
+
+	// KeyFile is the path to a file containing the base64-encoded key, as an alternative to Key
+	KeyFile string
+}
+
+// LoadEncryptionKey returns the decoded key from the Key or KeyFile of the config
+func LoadEncryptionKey(config EncryptionConfig) ([]byte, error) {
+	if config.Type != EncryptionTypeAESGCM {
+		return nil, fmt.Errorf("unrecognized encryption type '%s', must be '%s'", config.Type, EncryptionTypeAESGCM)
+	}
+
+	encoded := config.Key
+	if encoded == "" {
+		if config.KeyFile == "" {
+			return nil, errors.New("encryption config is missing a Key or KeyFile")
+		}
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read encryption key file: %s", err)
+		}
+		encoded = string(data)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %s", err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// Encrypt returns a reader that provides the encrypted contents of data. The data is encrypted
+// as it is read. The caller must close the returned reader.
+//
+// The output consists of a header (magic, wrapped data key, nonce prefix) followed by chunks of
+// AES-256-GCM ciphertext, each authenticated with a nonce made of the prefix, a chunk counter
+// and a final-chunk flag, so that truncation or reordering is detected on decryption.
+func Encrypt(data io.Reader, key []byte) (io.ReadCloser, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	header, err := encryptionHeader(key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := header[len(header)-encryptionPrefixSize:]
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(encryptTo(pw, data, header, aead, prefix))
+	}()
+	return pr, nil
+}
+
+// Decrypt reads data written by Encrypt from src and writes the plaintext to dst. An error is
+// returned if the key is wrong or the data has been modified or truncated, in which case dst may
+// have received part of the plaintext.
+func Decrypt(dst io.Writer, src io.Reader, key []byte) error {
+	header := make([]byte, len(encryptionMagic)+encryptionNonceSize+encryptionWrappedSize+encryptionPrefixSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return fmt.Errorf("unable to read encryption header: %s", err)
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		return errors.New("data is not in a recognized encrypted format")
+	}
+
+	keyAEAD, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	offset := len(encryptionMagic)
+	wrapNonce := header[offset : offset+encryptionNonceSize]
+	offset += encryptionNonceSize
+	wrappedKey := header[offset : offset+encryptionWrappedSize]
+	offset += encryptionWrappedSize
+	prefix := header[offset:]
+
+	dataKey, err := keyAEAD.Open(nil, wrapNonce, wrappedKey, encryptionMagic)
+	if err != nil {
+		return errors.New("unable to decrypt data key, the encryption key may be incorrect")
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, encryptionChunkSize+encryptionTagSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, chunk)
+		final := false
+		switch err {
+		case nil:
+		case io.ErrUnexpectedEOF:
+			final = true
+		case io.EOF:
+			return errors.New("encrypted data is truncated")
+		default:
+			return err
+		}
+
+		plaintext, err := aead.Open(chunk[:0], chunkNonce(prefix, counter, final), chunk[:n], nil)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt chunk %d, the data may be corrupt or truncated", counter)
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func encryptionHeader(key, dataKey []byte) ([]byte, error) {
+	keyAEAD, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapNonce := make([]byte, encryptionNonceSize)
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{}, encryptionMagic...)
+	header = append(header, wrapNonce...)
+	header = keyAEAD.Seal(header, wrapNonce, dataKey, encryptionMagic)
+	return append(header, prefix...), nil
+}
+
+func encryptTo(w io.Writer, data io.Reader, header []byte, aead cipher.AEAD, prefix []byte) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, encryptionChunkSize, encryptionChunkSize+encryptionTagSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(data, chunk)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+
+		ciphertext := aead.Seal(chunk[:0], chunkNonce(prefix, counter, final), chunk[:n], nil)
+		if _, err := w.Write(ciphertext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		chunk = chunk[:encryptionChunkSize]
+	}
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], counter)
+	if final {
+		nonce[encryptionNonceSize-1] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress/snappy"
+)
+
+const (
+	OutputFormatJSON    = "json"
+	OutputFormatCSV     = "csv"
+	OutputFormatParquet = "parquet"
+
+	ColumnTypeString    = "string"
+	ColumnTypeInt64     = "int64"
+	ColumnTypeDouble    = "double"
+	ColumnTypeBoolean   = "boolean"
+	ColumnTypeTimestamp = "timestamp"
+)
+
+// OutputFormat configures the conversion of a set's records to a tabular format. The records are
+// the elements of a JSON array, or the lines of NDJSON data.
+type OutputFormat struct {
+	// Type is "json" (default, no conversion), "csv" or "parquet"
+	Type string
+
+	// RecordsPath is the JSON path to the array of records. If empty, the data itself must be an
+	// array or NDJSON.
+	RecordsPath string
+
+	// Columns are the columns written, in order. If empty, the columns are inferred from the
+	// records: nested objects are flattened into columns named by their keys joined with "_",
+	// and Parquet column types are inferred from the values.
+	Columns []Column
+}
+
+// Column is a column of the output
+type Column struct {
+	// Name is the column name
+	Name string
+
+	// Path is the JSON path of the value in each record. Default: the Name
+	Path string
+
+	// Type is the Parquet column type: "string" (default), "int64", "double", "boolean" or
+	// "timestamp". Timestamps are RFC 3339 strings or milliseconds since the Unix epoch.
+	Type string
+}
+
+var contentTypes = map[string]string{
+	OutputFormatJSON:    "application/json",
+	OutputFormatCSV:     "text/csv",
+	OutputFormatParquet: "application/vnd.apache.parquet",
+}
+
+// Validate checks the format configuration and sets the column defaults
+func (f *OutputFormat) Validate() error {
+	if f.Type == "" {
+		f.Type = OutputFormatJSON
+	}
+	if _, ok := contentTypes[f.Type]; !ok {
+		return fmt.Errorf("unrecognized output format '%s'", f.Type)
+	}
+
+	names := map[string]bool{}
+	for i := range f.Columns {
+		c := &f.Columns[i]
+		if c.Name == "" {
+			return errors.New("output format columns must have a Name")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("output format column '%s' is listed twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.Path == "" {
+			c.Path = c.Name
+		}
+		switch c.Type {
+		case "":
+			c.Type = ColumnTypeString
+		case ColumnTypeString, ColumnTypeInt64, ColumnTypeDouble, ColumnTypeBoolean, ColumnTypeTimestamp:
+		default:
+			return fmt.Errorf("unrecognized type '%s' for column '%s'", c.Type, c.Name)
+		}
+	}
+	return nil
+}
+
+// IsJSON returns true if the data is not converted
+func (f OutputFormat) IsJSON() bool {
+	return f.Type == "" || f.Type == OutputFormatJSON
+}
+
+// Extension returns the file extension of the format, without a dot
+func (f OutputFormat) Extension() string {
+	if f.IsJSON() {
+		return OutputFormatJSON
+	}
+	return f.Type
+}
+
+// ContentType returns the media type of the format
+func (f OutputFormat) ContentType() string {
+	return contentTypes[f.Extension()]
+}
+
+// Convert reads the records from data and writes them to w in the output format
+func (f OutputFormat) Convert(w io.Writer, data io.Reader) error {
+	if f.IsJSON() {
+		_, err := io.Copy(w, data)
+		return err
+	}
+
+	records, err := readRecords(data, f.RecordsPath)
+	if err != nil {
+		return err
+	}
+
+	columns := f.Columns
+	if len(columns) == 0 {
+		columns = inferColumns(records)
+	}
+
+	rows := make([][]interface{}, len(records))
+	for i, record := range records {
+		flat := map[string]interface{}{}
+		flatten(flat, "", record)
+		row := make([]interface{}, len(columns))
+		for j, c := range columns {
+			if v, ok := flat[c.Path]; ok {
+				row[j] = v
+			} else {
+				row[j], _ = GetJSONPath(record, c.Path)
+			}
+		}
+		rows[i] = row
+	}
+
+	if f.Type == OutputFormatCSV {
+		return writeCSV(w, columns, rows)
+	}
+	return writeParquet(w, columns, rows)
+}
+
+// readRecords decodes the records from a JSON document or NDJSON lines. Numbers are decoded as
+// json.Number so that they keep their precision.
+func readRecords(data io.Reader, recordsPath string) ([]interface{}, error) {
+	decoder := json.NewDecoder(data)
+	decoder.UseNumber()
+
+	var values []interface{}
+	for {
+		var v interface{}
+		err := decoder.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read records, data is not valid JSON: %w", err)
+		}
+		values = append(values, v)
+	}
+
+	if len(values) != 1 {
+		return values, nil
+	}
+
+	doc := values[0]
+	if recordsPath != "" {
+		var ok bool
+		if doc, ok = GetJSONPath(doc, recordsPath); !ok {
+			return nil, fmt.Errorf("no records found at '%s'", recordsPath)
+		}
+	}
+	if list, ok := doc.([]interface{}); ok {
+		return list, nil
+	}
+	return []interface{}{doc}, nil
+}
+
+// flatten adds the values in v to flat, with nested object keys joined by dots
+func flatten(flat map[string]interface{}, prefix string, v interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		if prefix != "" {
+			flat[prefix] = v
+		}
+		return
+	}
+	for k, value := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		flatten(flat, key, value)
+	}
+}
+
+// inferColumns returns a column for each flattened field in the records, in the order they first
+// appear, with keys sorted within each record. A name that is already taken by another field, as
+// "a_b" is by both "a.b" and "a_b", is made unique with a numeric suffix, such as "a_b_2".
+func inferColumns(records []interface{}) []Column {
+	var columns []Column
+	index := map[string]int{}
+	names := map[string]bool{}
+	for _, record := range records {
+		flat := map[string]interface{}{}
+		flatten(flat, "", record)
+		for _, path := range sortedKeys(flat) {
+			i, ok := index[path]
+			if !ok {
+				i = len(columns)
+				index[path] = i
+				columns = append(columns, Column{Name: uniqueName(names, strings.ReplaceAll(path, ".", "_")), Path: path})
+			}
+			columns[i].Type = mergeColumnType(columns[i].Type, flat[path])
+		}
+	}
+	for i := range columns {
+		if columns[i].Type == "" {
+			columns[i].Type = ColumnTypeString
+		}
+	}
+	return columns
+}
+
+// uniqueName returns the name, or the name with the lowest numeric suffix that is not in names,
+// and adds it to names
+func uniqueName(names map[string]bool, name string) string {
+	unique := name
+	for n := 2; names[unique]; n++ {
+		unique = fmt.Sprintf("%s_%d", name, n)
+	}
+	names[unique] = true
+	return unique
+}
+
+// mergeColumnType returns the narrowest type that fits both the current type and the value. An
+// empty type means no values have been seen.
+func mergeColumnType(current string, value interface{}) string {
+	var t string
+	switch v := value.(type) {
+	case nil:
+		return current
+	case bool:
+		t = ColumnTypeBoolean
+	case json.Number:
+		t = ColumnTypeDouble
+		if _, err := v.Int64(); err == nil {
+			t = ColumnTypeInt64
+		}
+	default:
+		t = ColumnTypeString
+	}
+
+	switch {
+	case current == "" || current == t:
+		return t
+	case (current == ColumnTypeInt64 && t == ColumnTypeDouble) || (current == ColumnTypeDouble && t == ColumnTypeInt64):
+		return ColumnTypeDouble
+	}
+	return ColumnTypeString
+}
+
+func writeCSV(w io.Writer, columns []Column, rows [][]interface{}) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.Name
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, v := range row {
+			record[i] = cellString(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// cellString formats a value for a CSV cell or Parquet string column. Objects and arrays are
+// written as JSON.
+func cellString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	b, _ := marshalRecord(v)
+	return string(b)
+}
+
+func writeParquet(w io.Writer, columns []Column, rows [][]interface{}) error {
+	group := parquet.Group{}
+	for _, c := range columns {
+		group[c.Name] = parquet.Optional(parquetNode(c.Type))
+	}
+	schema := parquet.NewSchema("record", group)
+
+	// The schema orders its columns by name
+	columnIndexes := make([]int, len(columns))
+	for i, c := range columns {
+		leaf, _ := schema.Lookup(c.Name)
+		columnIndexes[i] = leaf.ColumnIndex
+	}
+
+	writer := parquet.NewWriter(w, schema, parquet.Compression(&snappy.Codec{}))
+	for n, row := range rows {
+		parquetRow := make(parquet.Row, len(columns))
+		for i, v := range row {
+			value, err := parquetValue(columns[i].Type, v)
+			if err != nil {
+				return fmt.Errorf("record %d, column '%s': %s", n+1, columns[i].Name, err)
+			}
+			definitionLevel := 1
+			if value.IsNull() {
+				definitionLevel = 0
+			}
+			parquetRow[columnIndexes[i]] = value.Level(0, definitionLevel, columnIndexes[i])
+		}
+		if _, err := writer.WriteRows([]parquet.Row{parquetRow}); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func parquetNode(columnType string) parquet.Node {
+	switch columnType {
+	case ColumnTypeInt64:
+		return parquet.Int(64)
+	case ColumnTypeDouble:
+		return parquet.Leaf(parquet.DoubleType)
+	case ColumnTypeBoolean:
+		return parquet.Leaf(parquet.BooleanType)
+	case ColumnTypeTimestamp:
+		return parquet.Timestamp(parquet.Millisecond)
+	}
+	return parquet.String()
+}
+
+// parquetValue converts a JSON value to a Parquet value of the column type
+func parquetValue(columnType string, v interface{}) (parquet.Value, error) {
+	if v == nil {
+		return parquet.Value{}, nil
+	}
+	s := cellString(v)
+
+	switch columnType {
+	case ColumnTypeInt64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return parquet.Value{}, fmt.Errorf("value '%s' is not an integer", s)
+		}
+		return parquet.Int64Value(i), nil
+	case ColumnTypeDouble:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return parquet.Value{}, fmt.Errorf("value '%s' is not a number", s)
+		}
+		return parquet.DoubleValue(f), nil
+	case ColumnTypeBoolean:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return parquet.Value{}, fmt.Errorf("value '%s' is not a boolean", s)
+		}
+		return parquet.BooleanValue(b), nil
+	case ColumnTypeTimestamp:
+		if _, isNumber := v.(json.Number); isNumber {
+			ms, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return parquet.Value{}, fmt.Errorf("value '%s' is not a timestamp", s)
+			}
+			return parquet.Int64Value(ms), nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return parquet.Value{}, fmt.Errorf("value '%s' is not an RFC 3339 timestamp", s)
+		}
+		return parquet.Int64Value(t.UnixMilli()), nil
+	}
+	return parquet.ByteArrayValue([]byte(s)), nil
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
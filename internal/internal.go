@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"log/syslog"
@@ -13,15 +16,22 @@ import (
 )
 
 const (
-	DefaultConfigFile = "./config.json"
-	DefaultVerbosity  = 5
-	DestinationTypeS3 = "S3"
-	SourceTypeRestAPI = "RestAPI"
+	DefaultConfigFile   = "./config.json"
+	DefaultVerbosity    = 5
+	DestinationTypeS3   = "S3"
+	DestinationTypeFile = "File"
+	SourceTypeRestAPI   = "RestAPI"
+	StateStoreTypeFile  = "File"
+	StateStoreTypeS3    = "S3"
+
+	maxPrintedResponse = 500
 )
 
 // LoadConfig looks for a config file if one is provided. Otherwise, it looks for
 // a config file based on the CONFIG_PATH env var.  If that is not set, it gets
-// the default config file ("./config.json").
+// the default config file ("./config.json"). Files ending in ".yaml" or ".yml" are
+// read as YAML, and files ending in ".jsonc" as JSON with comments. Values are then
+// overridden by RDA_ environment variables, and secret references are resolved.
 func LoadConfig(configFile string) (AppConfig, error) {
 	if configFile == "" {
 		configFile = os.Getenv("CONFIG_PATH")
@@ -38,6 +48,29 @@ func LoadConfig(configFile string) (AppConfig, error) {
 		return AppConfig{}, err
 	}
 
+	doc, err := decodeConfigFile(configFile, data)
+	if err != nil {
+		log.Printf("unable to decode application config file %s, error: %s\n", configFile, err.Error())
+		return AppConfig{}, err
+	}
+
+	doc, overrides, err := applyEnvOverlay(doc, os.Environ())
+	if err != nil {
+		return AppConfig{}, err
+	}
+	for _, name := range overrides {
+		log.Printf("Config value overridden by environment variable %s\n", name)
+	}
+
+	if data, err = marshalRecord(doc); err != nil {
+		return AppConfig{}, err
+	}
+
+	data, err = ResolveSecrets(data)
+	if err != nil {
+		return AppConfig{}, fmt.Errorf("error in application config file %s: %s", configFile, err)
+	}
+
 	config, err := parseConfig(data)
 	if err != nil {
 		return AppConfig{}, err
@@ -48,7 +81,7 @@ func LoadConfig(configFile string) (AppConfig, error) {
 
 func parseConfig(data []byte) (AppConfig, error) {
 	config := AppConfig{}
-	err := json.Unmarshal(data, &config)
+	err := UnmarshalConfig(data, &config)
 	if err != nil {
 		log.Printf("unable to unmarshal application configuration file data, error: %s\n", err.Error())
 		return config, err
@@ -62,6 +95,20 @@ func parseConfig(data []byte) (AppConfig, error) {
 		return config, errors.New("configuration appears to be missing a Destination configuration")
 	}
 
+	if config.Encryption.Type != "" {
+		if _, err := LoadEncryptionKey(config.Encryption); err != nil {
+			return config, fmt.Errorf("invalid Encryption configuration: %s", err)
+		}
+	}
+
+	for _, set := range config.Sets {
+		if set.Transform != nil {
+			if err := set.Transform.Validate(); err != nil {
+				return config, fmt.Errorf("invalid Transform in set '%s': %s", set.Name, err)
+			}
+		}
+	}
+
 	log.Printf("Configuration loaded. Source type: %s, Destination type: %s\n", config.Source.Type, config.Destination.Type)
 	log.Printf("%v Archive sets found:\n", len(config.Sets))
 
@@ -71,53 +118,224 @@ func parseConfig(data []byte) (AppConfig, error) {
 	return config, nil
 }
 
-// RunSet calls the source API and writes the result to the destination adapter
-func RunSet(logger *log.Logger, source Source, destination Destination, config AppConfig) error {
-	sourceData, err := source.Read()
+// RunSet calls the source API and writes the result to the destination adapter. If the source
+// and destination support streaming, the data is passed through without being held in memory.
+// If a StateStore is given, the set's state is provided to the source and updated after the data
+// is archived.
+func RunSet(logger *log.Logger, set Set, source Source, destination Destination, state StateStore, config AppConfig) error {
+	// Create a channel to pass activity logs for printing
+	eventLog := make(chan EventLogItem, 50)
+	eventLogDone := make(chan struct{})
+	go processEventLog(logger, config.Alert, eventLog, eventLogDone)
+	defer closeEventLog(eventLog, eventLogDone)
+
+	if l, ok := source.(EventLogger); ok {
+		l.SetEventLog(eventLog)
+	}
+
+	if m, ok := source.(MetadataSource); ok {
+		if d, ok := destination.(MetadataDestination); ok {
+			d.SetMetadataSource(m)
+		}
+	}
+
+	runTime := time.Now()
+	var setState SetState
+	if state != nil {
+		var err error
+		if setState, err = state.Load(set.Name); err != nil {
+			return fmt.Errorf("error loading the state of the set: %s", err)
+		}
+	}
+	if s, ok := source.(StatefulSource); ok {
+		if err := s.SetState(runTime, setState); err != nil {
+			return err
+		}
+	}
+
+	sourceData, err := AsStreamSource(source).ReadStream()
 	if err != nil {
 		return err
 	}
+	defer sourceData.Close()
+
+	// Keep the source's read error, which would otherwise be reported by the destination
+	sourceReader := &errorRecordingReader{Reader: sourceData}
+
+	// Count the bytes read, to be recorded in the set's state
+	counter := &countingReader{Reader: sourceReader}
+	var data io.Reader = counter
+
+	if set.Transform != nil {
+		transformed, err := set.Transform.Transform(data)
+		if err != nil {
+			return err
+		}
+		data = bytes.NewReader(transformed)
+
+		if d, ok := destination.(FormatDestination); ok {
+			d.SetDataFormat(set.Transform.Format)
+		}
+	}
 
 	// If in DryRun mode only print out the config and any results from calling the source API
 	if config.Runtime.DryRunMode {
 		logger.Println("Dry-run mode enabled. No data will be written to the destination.")
-		printSourceResponse(logger, sourceData)
+		response, err := ioutil.ReadAll(io.LimitReader(data, maxPrintedResponse+1))
+		if err != nil {
+			return err
+		}
+		printSourceResponse(logger, response)
+		prune(destination, true, eventLog)
 		return nil
 	}
 
-	// Create a channel to pass activity logs for printing
-	eventLog := make(chan EventLogItem, 50)
-	go processEventLog(logger, config.Alert, eventLog)
+	// Compare the hash of the data to that of the last archive, before it is encrypted
+	var changeDetector ChangeDetector
+	var contentHash string
+	if set.skipIfUnchanged(config.Runtime) {
+		var ok bool
+		if changeDetector, ok = destination.(ChangeDetector); !ok {
+			eventLog <- EventLogItem{
+				Level:   syslog.LOG_WARNING,
+				Message: "SkipIfUnchanged is not supported by this destination",
+			}
+		} else {
+			spooled, err := Spool(data)
+			if err != nil {
+				return fmt.Errorf("error buffering data to compute its hash: %s", err)
+			}
+			defer spooled.Close()
+			data = spooled
+			contentHash = spooled.Hash
+
+			lastHash, err := changeDetector.LastContentHash()
+			if err != nil {
+				eventLog <- EventLogItem{
+					Level:   syslog.LOG_WARNING,
+					Message: fmt.Sprintf("unable to read the hash of the last archive: %s", err),
+				}
+			} else if lastHash == contentHash {
+				eventLog <- EventLogItem{
+					Level:   syslog.LOG_NOTICE,
+					Message: fmt.Sprintf("data is unchanged since the last archive (SHA-256 %s), skipping", contentHash),
+				}
+				setState.Size = counter.n
+				saveState(state, set.Name, setState, source, runTime, eventLog)
+				return nil
+			}
+		}
+	}
+
+	if config.Encryption.Type != "" {
+		key, err := LoadEncryptionKey(config.Encryption)
+		if err != nil {
+			return err
+		}
+		// A destination that compresses the data must encrypt it after compression
+		if e, ok := destination.(EncryptingDestination); ok {
+			e.SetEncryptionKey(key)
+		} else {
+			encrypted, err := Encrypt(data, key)
+			if err != nil {
+				return fmt.Errorf("error initializing encryption: %s", err)
+			}
+			defer encrypted.Close()
+			data = encrypted
+		}
+	}
 
-	if err := destination.Write(sourceData, eventLog); err != nil {
+	err = AsStreamDestination(destination).WriteStream(data, eventLog)
+	if sourceReader.err != nil {
+		return fmt.Errorf("error reading from source: %w", sourceReader.err)
+	}
+	if err != nil {
 		logger.Println("Error saving to destination:", err.Error())
-	} else {
-		logger.Println("Data saved to destination")
+		return nil
 	}
+	logger.Println("Data saved to destination")
 
-	for i := 0; i < 100; i++ {
-		time.Sleep(time.Millisecond * 10)
-		if len(eventLog) == 0 {
-			break
+	if contentHash != "" {
+		if err := changeDetector.SaveContentHash(contentHash); err != nil {
+			eventLog <- EventLogItem{
+				Level:   syslog.LOG_WARNING,
+				Message: fmt.Sprintf("unable to save the hash of this archive: %s", err),
+			}
 		}
 	}
-	close(eventLog)
+
+	setState.Size = counter.n
+	saveState(state, set.Name, setState, source, runTime, eventLog)
+
+	prune(destination, false, eventLog)
 
 	return nil
 }
 
-func processEventLog(logger *log.Logger, config alert.Config, eventLog <-chan EventLogItem) {
+// saveState records the run time and the source's watermark in the set's state, if a StateStore
+// is configured. It must only be called once the data has been archived.
+func saveState(state StateStore, setName string, setState SetState, source Source, runTime time.Time,
+	eventLog chan<- EventLogItem) {
+	if state == nil {
+		return
+	}
+	setState.LastRunTime = runTime.UTC()
+	if w, ok := source.(WatermarkSource); ok {
+		if watermark := w.Watermark(); watermark != "" && watermark != setState.Watermark {
+			eventLog <- EventLogItem{
+				Level:   syslog.LOG_INFO,
+				Message: fmt.Sprintf("watermark advanced from '%s' to '%s'", setState.Watermark, watermark),
+			}
+			setState.Watermark = watermark
+		}
+	}
+	if err := state.Save(setName, setState); err != nil {
+		eventLog <- EventLogItem{
+			Level:   syslog.LOG_ERR,
+			Message: fmt.Sprintf("unable to save the state of the set: %s", err),
+		}
+	}
+}
+
+// prune removes old archives if the destination supports a retention policy
+func prune(destination Destination, dryRun bool, eventLog chan<- EventLogItem) {
+	pruner, ok := destination.(Pruner)
+	if !ok {
+		return
+	}
+	if err := pruner.Prune(dryRun, eventLog); err != nil {
+		eventLog <- EventLogItem{
+			Level:   syslog.LOG_ERR,
+			Message: fmt.Sprintf("error removing old archives: %s", err),
+		}
+	}
+}
+
+// closeEventLog closes the channel and waits for the remaining events to be processed, including
+// sending any alerts, so that none are lost when the process exits
+func closeEventLog(eventLog chan EventLogItem, done <-chan struct{}) {
+	close(eventLog)
+	<-done
+}
+
+// sendEmail sends an alert email. It is a variable so that tests can replace it.
+var sendEmail = alert.SendEmail
+
+// processEventLog logs each event and sends alerts by email, closing done once the channel is
+// closed and all events are processed
+func processEventLog(logger *log.Logger, config alert.Config, eventLog <-chan EventLogItem, done chan<- struct{}) {
+	defer close(done)
 	for msg := range eventLog {
 		logger.Println(msg)
 		if msg.Level == syslog.LOG_ALERT || msg.Level == syslog.LOG_EMERG {
-			alert.SendEmail(config, msg.String())
+			sendEmail(config, RedactSecrets(msg.String()))
 		}
 	}
 }
 
 func printSourceResponse(logger *log.Logger, response []byte) {
-	if len(response) > 500 {
-		logger.Printf("response:\n%s...(truncated)", response[0:500])
+	if len(response) > maxPrintedResponse {
+		logger.Printf("response:\n%s...(truncated)", response[0:maxPrintedResponse])
 	} else {
 		logger.Printf("response:\n%s\n", response)
 	}
@@ -135,6 +353,14 @@ func (e *EmptySource) ForSet(setJson json.RawMessage) error {
 	return nil
 }
 
+// skipIfUnchanged returns the set's SkipIfUnchanged setting, or the runtime default if not set
+func (s Set) skipIfUnchanged(runtime RuntimeConfig) bool {
+	if s.SkipIfUnchanged != nil {
+		return *s.SkipIfUnchanged
+	}
+	return runtime.SkipIfUnchanged
+}
+
 func (a *AppConfig) MaxSetNameLength() int {
 	maxLength := 0
 	for _, set := range a.Sets {
@@ -1,12 +1,29 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/syslog"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/parquet-go/parquet-go"
 	"github.com/stretchr/testify/require"
+
+	"github.com/silinternational/rest-data-archiver/alert"
 )
 
 func TestMain(m *testing.M) {
@@ -61,3 +78,998 @@ func Test_parseConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfig(t *testing.T) {
+	const want = `{"Source":{"Type":"RestAPI","AdapterConfig":{"BaseURL":"https://example.com","BatchSize":10}},` +
+		`"Destination":{"Type":"S3"},"Sets":[{"Name":"Users","Source":{"Path":"/users"}}]}`
+
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			data: want,
+		},
+		{
+			name: "yaml",
+			file: "config.yml",
+			data: `
+Source:
+  Type: RestAPI
+  AdapterConfig:
+    BaseURL: https://example.com
+    BatchSize: 10
+Destination:
+  Type: S3
+Sets:
+  - Name: Users
+    Source:
+      Path: /users
+`,
+		},
+		{
+			name: "json with comments",
+			file: "config.jsonc",
+			data: `{
+  // The source
+  "Source": {"Type": "RestAPI", "AdapterConfig": {"BaseURL": "https://example.com", /* "//" in a string */ "BatchSize": 10,},},
+  "Destination": {"Type": "S3"},
+  "Sets": [{"Name": "Users", "Source": {"Path": "/users"}}, /* trailing comma */],
+}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := t.TempDir() + "/" + tt.file
+			require.NoError(t, os.WriteFile(configFile, []byte(tt.data), 0600))
+
+			got, err := LoadConfig(configFile)
+			require.NoError(t, err)
+
+			var wantConfig AppConfig
+			require.NoError(t, json.Unmarshal([]byte(want), &wantConfig))
+			require.Equal(t, wantConfig.Sets, got.Sets)
+			require.Equal(t, wantConfig.Destination, got.Destination)
+			require.JSONEq(t, string(wantConfig.Source.AdapterConfig), string(got.Source.AdapterConfig))
+		})
+	}
+
+	for _, file := range []string{"config.json", "config.jsonc"} {
+		_, err := decodeConfigFile(file, []byte(`{"Source":{}} {"Sets":[]}`))
+		require.Error(t, err, "trailing data in %s", file)
+	}
+
+	require.JSONEq(t, `{"a":"// not a comment","b":[1]}`,
+		string(stripJSONComments([]byte(`{"a":"// not a comment", // a comment
+"b":[1,],}`))))
+}
+
+func TestLoadConfig_NumbersInStrings(t *testing.T) {
+	configFile := t.TempDir() + "/config.yaml"
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+Source:
+  Type: RestAPI
+  AdapterConfig:
+    Password: 0123
+Destination:
+  Type: S3
+Alert:
+  AWSAccessKeyID: 123456
+  AWSExternalID: 000123456789
+  SubjectText: true
+  RecipientEmails: [1]
+Sets:
+  - Name: 2024
+    Source:
+      Version: 1.10
+`), 0600))
+	require.NoError(t, os.Setenv("RDA_SOURCE_ADAPTERCONFIG_USERNAME", "1234"))
+	defer os.Unsetenv("RDA_SOURCE_ADAPTERCONFIG_USERNAME")
+
+	config, err := LoadConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, "123456", config.Alert.AWSAccessKeyID)
+	require.Equal(t, "000123456789", config.Alert.AWSExternalID)
+	require.Equal(t, "true", config.Alert.SubjectText)
+	require.Equal(t, []string{"1"}, config.Alert.RecipientEmails)
+	require.Equal(t, "2024", config.Sets[0].Name)
+
+	var adapterConfig struct {
+		Username string
+		Password string
+	}
+	require.NoError(t, UnmarshalConfig(config.Source.AdapterConfig, &adapterConfig))
+	require.Equal(t, "1234", adapterConfig.Username)
+	require.Equal(t, "0123", adapterConfig.Password)
+
+	var setConfig struct{ Version string }
+	require.NoError(t, UnmarshalConfig(config.Sets[0].Source, &setConfig))
+	require.Equal(t, "1.10", setConfig.Version)
+
+	var typed struct {
+		Count int
+		Ratio *float64
+	}
+	require.NoError(t, UnmarshalConfig([]byte(`{"Count":"010","Ratio":"0.5"}`), &typed))
+	require.Equal(t, 10, typed.Count)
+	require.Equal(t, 0.5, *typed.Ratio)
+	require.Error(t, UnmarshalConfig([]byte(`{"Count":"ten"}`), &typed))
+}
+
+func Test_decodeConfigFile_YAML(t *testing.T) {
+	doc, err := decodeConfigFile("config.yaml", []byte(`
+since: 2024-01-02
+at: 2024-01-02T03:04:05Z
+version: 1.10
+count: 0x10
+account: 000123456789
+ratio: 1.5
+enabled: yes
+flag: true
+none: null
+tagged: !!binary aGVsbG8=
+base: &base
+  path: /users
+copy: *base
+`))
+	require.NoError(t, err)
+	got, err := json.Marshal(doc)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"since":"2024-01-02","at":"2024-01-02T03:04:05Z","version":1.1,"count":16,"account":"000123456789","ratio":1.5,`+
+		`"enabled":"yes","flag":true,"none":null,"tagged":"aGVsbG8=","base":{"path":"/users"},"copy":{"path":"/users"}}`,
+		string(got))
+
+	doc, err = decodeConfigFile("config.yaml", []byte("1: a\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"1": "a"}, doc, "scalar keys should be kept as strings")
+
+	for _, data := range []string{"? [a, b]\n: c\n", "a: .inf\n"} {
+		_, err := decodeConfigFile("config.yml", []byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func Test_applyEnvOverlay(t *testing.T) {
+	doc := func() interface{} {
+		var v interface{}
+		require.NoError(t, json.Unmarshal([]byte(`{"Source":{"AdapterConfig":{"BaseURL":"https://staging","BatchSize":10,`+
+			`"Headers":{"X_Env":"staging"}}},"Sets":[{"Name":"Users","Source":{"Path":"/users"}},{"name":"Groups"}]}`), &v))
+		return v
+	}
+
+	tests := []struct {
+		name    string
+		env     []string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no variables",
+			env:  []string{"HOME=/root", "RDA_=x"},
+			want: `{"Source":{"AdapterConfig":{"BaseURL":"https://staging","BatchSize":10,"Headers":{"X_Env":"staging"}}},` +
+				`"Sets":[{"Name":"Users","Source":{"Path":"/users"}},{"name":"Groups"}]}`,
+		},
+		{
+			name: "override and add values",
+			env: []string{
+				"RDA_SOURCE_ADAPTERCONFIG_BASEURL=https://prod",
+				"RDA_SOURCE_ADAPTERCONFIG_BATCHSIZE=50",
+				"RDA_SOURCE_ADAPTERCONFIG_HEADERS_X_ENV=prod",
+				"RDA_RUNTIME_DRYRUNMODE=true",
+				"RDA_SETS_0_SOURCE_PATH=/v2/users",
+				"RDA_SETS_GROUPS_SOURCE={\"Path\":\"/groups\"}",
+			},
+			want: `{"Source":{"AdapterConfig":{"BaseURL":"https://prod","BatchSize":50,"Headers":{"X_Env":"prod"}}},` +
+				`"RUNTIME":{"DRYRUNMODE":true},` +
+				`"Sets":[{"Name":"Users","Source":{"Path":"/v2/users"}},{"name":"Groups","SOURCE":{"Path":"/groups"}}]}`,
+		},
+		{
+			name:    "unknown set",
+			env:     []string{"RDA_SETS_ROLES_SOURCE_PATH=/roles"},
+			wantErr: "RDA_SETS_ROLES_SOURCE_PATH",
+		},
+		{
+			name:    "index out of range",
+			env:     []string{"RDA_SETS_5_NAME=x"},
+			wantErr: "out of range",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := applyEnvOverlay(doc(), tt.env)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			gotJSON, err := json.Marshal(got)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(gotJSON))
+		})
+	}
+}
+
+func TestGetJSONPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"paging": map[string]interface{}{"next": "/page/2"},
+		"records": []interface{}{
+			map[string]interface{}{"Name": "Mickey", "Age": float64(95)},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		want   string
+		wantOK bool
+	}{
+		{name: "object key", path: "paging.next", want: "/page/2", wantOK: true},
+		{name: "leading dollar", path: "$.paging.next", want: "/page/2", wantOK: true},
+		{name: "array index", path: "records.0.Name", want: "Mickey", wantOK: true},
+		{name: "bracket index", path: "records[0].Age", want: "95", wantOK: true},
+		{name: "missing key", path: "paging.prev", wantOK: false},
+		{name: "index out of range", path: "records.1.Name", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := GetJSONPath(doc, tt.path)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.want, GetJSONPathString(doc, tt.path))
+		})
+	}
+}
+
+type testSource struct {
+	data []byte
+}
+
+func (t *testSource) ForSet(setName string, setJson json.RawMessage) (Source, error) {
+	return t, nil
+}
+
+func (t *testSource) Read() ([]byte, error) {
+	return t.data, nil
+}
+
+type testDestination struct {
+	written []byte
+}
+
+func (t *testDestination) ForSet(setName string, setJson json.RawMessage) (Destination, error) {
+	return t, nil
+}
+
+func (t *testDestination) Write(data []byte, activityLog chan<- EventLogItem) error {
+	t.written = data
+	return nil
+}
+
+type testStreamDestination struct {
+	testDestination
+}
+
+func (t *testStreamDestination) WriteStream(data io.Reader, activityLog chan<- EventLogItem) error {
+	b, err := ioutil.ReadAll(data)
+	t.written = append([]byte("stream:"), b...)
+	return err
+}
+
+func TestRunSet(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	source := &testSource{data: []byte(`[{"id":1}]`)}
+
+	t.Run("byte destination", func(t *testing.T) {
+		destination := &testDestination{}
+		require.NoError(t, RunSet(logger, Set{}, source, destination, nil, AppConfig{}))
+		require.Equal(t, `[{"id":1}]`, string(destination.written))
+	})
+
+	t.Run("stream destination", func(t *testing.T) {
+		destination := &testStreamDestination{}
+		require.NoError(t, RunSet(logger, Set{}, source, destination, nil, AppConfig{}))
+		require.Equal(t, `stream:[{"id":1}]`, string(destination.written))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		destination := &testDestination{}
+		config := AppConfig{Runtime: RuntimeConfig{DryRunMode: true}}
+		require.NoError(t, RunSet(logger, Set{}, source, destination, nil, config))
+		require.Nil(t, destination.written)
+	})
+}
+
+type testStateStore struct {
+	states map[string]SetState
+}
+
+func (t *testStateStore) Load(setName string) (SetState, error) {
+	return t.states[setName], nil
+}
+
+func (t *testStateStore) Save(setName string, state SetState) error {
+	t.states[setName] = state
+	return nil
+}
+
+type testStatefulSource struct {
+	testSource
+	now   time.Time
+	state SetState
+}
+
+func (t *testStatefulSource) SetState(now time.Time, state SetState) error {
+	t.now, t.state = now, state
+	return nil
+}
+
+func TestRunSet_State(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	lastRun := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	state := &testStateStore{states: map[string]SetState{"users": {LastRunTime: lastRun}}}
+	source := &testStatefulSource{testSource: testSource{data: []byte(`[]`)}}
+
+	before := time.Now()
+	require.NoError(t, RunSet(logger, Set{Name: "users"}, source, &testDestination{}, state, AppConfig{}))
+	require.Equal(t, lastRun, source.state.LastRunTime)
+	require.False(t, source.now.Before(before))
+	require.True(t, source.now.Equal(state.states["users"].LastRunTime))
+	require.Equal(t, int64(2), state.states["users"].Size)
+
+	// the state is not updated in dry-run mode
+	config := AppConfig{Runtime: RuntimeConfig{DryRunMode: true}}
+	saved := state.states["users"]
+	require.NoError(t, RunSet(logger, Set{Name: "users"}, source, &testDestination{}, state, config))
+	require.Equal(t, saved, state.states["users"])
+}
+
+type testWatermarkSource struct {
+	testStatefulSource
+	watermark string
+}
+
+func (t *testWatermarkSource) Watermark() string {
+	return t.watermark
+}
+
+type testFailingDestination struct {
+	testDestination
+}
+
+func (t *testFailingDestination) Write(data []byte, activityLog chan<- EventLogItem) error {
+	return fmt.Errorf("write failed")
+}
+
+type testAlertingDestination struct {
+	testDestination
+}
+
+func (t *testAlertingDestination) Write(data []byte, activityLog chan<- EventLogItem) error {
+	activityLog <- EventLogItem{Level: syslog.LOG_ALERT, Message: "something went wrong"}
+	return nil
+}
+
+func TestRunSet_WaitsForAlerts(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	var sent []string
+	sendEmail = func(config alert.Config, msg string) {
+		time.Sleep(2 * time.Second)
+		sent = append(sent, msg)
+	}
+	defer func() { sendEmail = alert.SendEmail }()
+
+	source := &testSource{data: []byte(`[]`)}
+	require.NoError(t, RunSet(logger, Set{Name: "users"}, source, &testAlertingDestination{}, nil, AppConfig{}))
+	require.Len(t, sent, 1, "the alert must be sent before RunSet returns")
+	require.Contains(t, sent[0], "something went wrong")
+}
+
+func TestRunSet_Watermark(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	state := &testStateStore{states: map[string]SetState{"users": {Watermark: "2021-01-01"}}}
+	source := &testWatermarkSource{testStatefulSource: testStatefulSource{testSource: testSource{data: []byte(`[]`)}}}
+
+	source.watermark = "2021-02-01"
+	require.NoError(t, RunSet(logger, Set{Name: "users"}, source, &testFailingDestination{}, state, AppConfig{}))
+	require.Equal(t, "2021-01-01", state.states["users"].Watermark, "watermark must not advance if the write fails")
+
+	require.NoError(t, RunSet(logger, Set{Name: "users"}, source, &testDestination{}, state, AppConfig{}))
+	require.Equal(t, "2021-02-01", state.states["users"].Watermark)
+	require.Equal(t, "2021-01-01", source.state.Watermark, "source should receive the saved watermark")
+}
+
+type testFailingStreamSource struct {
+	testSource
+}
+
+func (t *testFailingStreamSource) ReadStream() (io.ReadCloser, error) {
+	failing := io.MultiReader(bytes.NewReader(t.data), iotest.ErrReader(errors.New("connection reset")))
+	return ioutil.NopCloser(failing), nil
+}
+
+func TestRunSet_SourceStreamFails(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	state := &testStateStore{states: map[string]SetState{}}
+	source := &testFailingStreamSource{testSource: testSource{data: []byte(`[{"id":1}`)}}
+
+	for name, destination := range map[string]Destination{
+		"byte destination":   &testDestination{},
+		"stream destination": &testStreamDestination{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := RunSet(logger, Set{Name: "users"}, source, destination, state, AppConfig{})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "error reading from source: connection reset")
+			require.NotContains(t, state.states, "users", "state must not be saved if the read fails")
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	require.NoError(t, os.Setenv("TEST_TENANT", "north"))
+	defer os.Unsetenv("TEST_TENANT")
+
+	data := TemplateData{
+		Now:     time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		SetName: "users",
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr string
+	}{
+		{name: "no template", text: "/users?a={b}", want: "/users?a={b}"},
+		{name: "date", text: `{{ .Now | date "2006-01-02" }}`, want: "2021-03-04"},
+		{name: "named layout", text: `{{ .Now | date "RFC3339" }}`, want: "2021-03-04T05:06:07Z"},
+		{name: "unix", text: `{{ .Now | date "Unix" }}`, want: "1614834367"},
+		{name: "add days", text: `{{ .Now | add "-7d" | date "2006-01-02" }}`, want: "2021-02-25"},
+		{
+			name: "default last run time",
+			text: `{{ .LastRunTime | default (.Now | add "-24h") | date "RFC3339" }}`,
+			want: "2021-03-03T05:06:07Z",
+		},
+		{name: "env", text: `/{{ env "TEST_TENANT" }}/{{ .SetName }}`, want: "/north/users"},
+		{name: "bad duration", text: `{{ .Now | add "yesterday" }}`, wantErr: "invalid duration"},
+		{name: "unknown field", text: `{{ .Then }}`, wantErr: "can't evaluate field Then"},
+		{name: "syntax error", text: `{{ .Now `, wantErr: "invalid template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderTemplate(tt.text, data)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	source := &testSource{}
+	RegisterSource("TestSource", func(sourceConfig SourceConfig) (Source, error) {
+		return source, nil
+	})
+	destination := &testDestination{}
+	RegisterDestination("TestDestination", func(destinationConfig DestinationConfig) (Destination, error) {
+		return destination, nil
+	})
+
+	gotSource, err := NewSource(SourceConfig{Type: "TestSource"})
+	require.NoError(t, err)
+	require.Equal(t, source, gotSource)
+
+	gotDestination, err := NewDestination(DestinationConfig{Type: "TestDestination"})
+	require.NoError(t, err)
+	require.Equal(t, destination, gotDestination)
+
+	_, err = NewSource(SourceConfig{Type: "NoSuchSource"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unrecognized source type")
+
+	_, err = NewDestination(DestinationConfig{Type: "NoSuchDestination"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unrecognized destination type")
+
+	require.Panics(t, func() {
+		RegisterSource("TestSource", func(sourceConfig SourceConfig) (Source, error) { return nil, nil })
+	})
+	require.Contains(t, SourceTypes(), "TestSource")
+	require.Contains(t, DestinationTypes(), "TestDestination")
+}
+
+func TestCompress(t *testing.T) {
+	data := strings.Repeat(`{"id":1,"name":"Mickey Mouse"},`, 100)
+
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			compressed, err := Compress(strings.NewReader(data), compression)
+			require.NoError(t, err)
+			compressedBytes, err := ioutil.ReadAll(compressed)
+			require.NoError(t, err)
+			require.NoError(t, compressed.Close())
+			if compression != CompressionNone {
+				require.Less(t, len(compressedBytes), len(data))
+			}
+
+			decompressed, err := Decompress(bytes.NewReader(compressedBytes), compression)
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(decompressed)
+			require.NoError(t, err)
+			require.Equal(t, data, string(got))
+		})
+	}
+
+	_, err := Compress(strings.NewReader(data), "lzma")
+	require.Error(t, err)
+}
+
+func TestEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	config := EncryptionConfig{Type: EncryptionTypeAESGCM, Key: base64.StdEncoding.EncodeToString(key)}
+	loadedKey, err := LoadEncryptionKey(config)
+	require.NoError(t, err)
+	require.Equal(t, key, loadedKey)
+
+	sizes := []int{0, 10, encryptionChunkSize, encryptionChunkSize*2 + 100}
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			data := bytes.Repeat([]byte("x"), size)
+			encrypted, err := Encrypt(bytes.NewReader(data), key)
+			require.NoError(t, err)
+			ciphertext, err := ioutil.ReadAll(encrypted)
+			require.NoError(t, err)
+			require.NotContains(t, string(ciphertext), "xxxxxxxxxx")
+
+			var plaintext bytes.Buffer
+			require.NoError(t, Decrypt(&plaintext, bytes.NewReader(ciphertext), key))
+			require.Equal(t, string(data), plaintext.String())
+
+			err = Decrypt(ioutil.Discard, bytes.NewReader(ciphertext), bytes.Repeat([]byte{8}, 32))
+			require.Error(t, err, "decrypt with the wrong key should fail")
+
+			err = Decrypt(ioutil.Discard, bytes.NewReader(ciphertext[:len(ciphertext)-1]), key)
+			require.Error(t, err, "decrypt of truncated data should fail")
+		})
+	}
+
+	_, err = LoadEncryptionKey(EncryptionConfig{Type: EncryptionTypeAESGCM, Key: "c2hvcnQ="})
+	require.Error(t, err)
+}
+
+func TestObjectKeyTemplate(t *testing.T) {
+	values := ObjectKeyValues{
+		SetName: "Users",
+		RunID:   "20191114T061537Z-0a1b2c3d",
+		Time:    time.Date(2019, 11, 14, 6, 15, 37, 123, time.UTC),
+		Hash:    "abc123",
+		Ext:     "json.gz",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "partitioned",
+			template: "{set}/year={yyyy}/month={mm}/day={dd}/{set}_{timestamp:RFC3339}.{ext}",
+			want:     "Users/year=2019/month=11/day=14/Users_2019-11-14T06:15:37Z.json.gz",
+		},
+		{
+			name:     "run id, hour and hash",
+			template: "{run_id}/{hh}/{hash}",
+			want:     "20191114T061537Z-0a1b2c3d/06/abc123",
+		},
+		{
+			name:     "timestamps",
+			template: "{timestamp}_{timestamp:Unix}_{timestamp:Compact}_{timestamp:2006-01-02}",
+			want:     "1573712137000000123_1573712137_20191114T061537Z_2019-11-14",
+		},
+		{
+			name:     "unknown variable",
+			template: "{set}/{unknown}",
+			wantErr:  "unrecognized variable '{unknown}'",
+		},
+		{
+			name:     "unclosed brace",
+			template: "{set",
+			wantErr:  "unclosed '{'",
+		},
+		{
+			name:     "unmatched brace",
+			template: "set}",
+			wantErr:  "unmatched '}'",
+		},
+		{
+			name:     "unexpected argument",
+			template: "{set:upper}",
+			wantErr:  "does not take an argument",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseObjectKeyTemplate(tt.template)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, tmpl.Execute(values))
+		})
+	}
+}
+
+func TestRetentionPolicy_Expired(t *testing.T) {
+	now := time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	// one archive per day, from 2020-01-01 through 2020-03-15
+	var objects []ArchivedObject
+	for d := now; !d.Before(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)); d = d.AddDate(0, 0, -1) {
+		objects = append(objects, ArchivedObject{Key: d.Format("2006-01-02"), Modified: d})
+	}
+
+	keptKeys := func(policy RetentionPolicy) []string {
+		expired := map[string]bool{}
+		for _, key := range policy.Expired(objects, now) {
+			expired[key] = true
+		}
+		var kept []string
+		for _, o := range objects {
+			if !expired[o.Key] {
+				kept = append(kept, o.Key)
+			}
+		}
+		return kept
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []string
+	}{
+		{
+			name:   "no policy",
+			policy: RetentionPolicy{},
+			want:   keptKeys(RetentionPolicy{KeepLast: len(objects)}),
+		},
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{KeepLast: 2},
+			want:   []string{"2020-03-15", "2020-03-14"},
+		},
+		{
+			name:   "keep days",
+			policy: RetentionPolicy{KeepDays: 3},
+			want:   []string{"2020-03-15", "2020-03-14", "2020-03-13"},
+		},
+		{
+			name:   "grandfather-father-son",
+			policy: RetentionPolicy{KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 3},
+			want:   []string{"2020-03-15", "2020-03-14", "2020-03-08", "2020-02-29", "2020-01-31"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, keptKeys(tt.policy))
+		})
+	}
+
+	expired := RetentionPolicy{KeepLast: len(objects) - 2}.Expired(objects, now)
+	require.Equal(t, []string{"2020-01-01", "2020-01-02"}, expired, "expired keys should be oldest first")
+}
+
+func TestObjectKeyTemplate_StaticPrefix(t *testing.T) {
+	tmpl, err := ParseObjectKeyTemplate("archive/{set}/year={yyyy}/{set}.{ext}")
+	require.NoError(t, err)
+	require.Equal(t, "archive/Users/year=", tmpl.StaticPrefix("Users"))
+
+	tmpl, err = ParseObjectKeyTemplate("{run_id}/{set}")
+	require.NoError(t, err)
+	require.Equal(t, "", tmpl.StaticPrefix("Users"))
+}
+
+func TestObjectKeyTemplate_Pattern(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	values := ObjectKeyValues{SetName: "hr", RunID: NewRunID(now), Time: now, Hash: strings.Repeat("ab", 32), Ext: "json.gz"}
+
+	for _, template := range []string{
+		"{set}/{yyyy}/{mm}/{dd}/{hh}/{timestamp}.{ext}",
+		"{set}_{timestamp:RFC3339Nano}_{run_id}",
+		"{set}-{timestamp:Jan 2 2006}-{hash}",
+		"{set}_{timestamp:Unix}",
+	} {
+		tmpl, err := ParseObjectKeyTemplate(template)
+		require.NoError(t, err)
+		pattern := regexp.MustCompile("^" + tmpl.Pattern("hr") + "$")
+
+		for _, nsec := range []int{0, 500} {
+			values.Time = now.Add(time.Duration(nsec))
+			require.True(t, pattern.MatchString(tmpl.Execute(values)), "%s: %s", template, tmpl.Execute(values))
+		}
+		values.SetName = "hr_payroll"
+		require.False(t, pattern.MatchString(tmpl.Execute(values)), "%s: %s", template, tmpl.Execute(values))
+		values.SetName = "hr"
+	}
+}
+
+func TestTransformConfig_Transform(t *testing.T) {
+	data := `{"data":{"users":[
+		{"id":12345678901234567,"name":"Ann","ssn":"123-45-6789","dob":"1990-01-01","address":{"zip":"12345","city":"X"}},
+		{"id":2,"name":"Bob","ssn":null,"age":40}
+	]}}`
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("123-45-6789"))
+	ssnHash := mac.Sum(nil)
+
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "select",
+			config: TransformConfig{Select: "data.users[?age > `30`].name"},
+			want:   `["Bob"]`,
+		},
+		{
+			name: "drop, hash and rename",
+			config: TransformConfig{
+				Select:  "data.users",
+				Drop:    []string{"dob", "address.city", "missing.field"},
+				Hash:    []string{"ssn"},
+				HashKey: "key",
+				Rename:  map[string]string{"address.zip": "postal_code", "name": "full_name"},
+			},
+			want: `[
+				{"id":12345678901234567,"full_name":"Ann","ssn":"` + hex.EncodeToString(ssnHash) + `","address":{"postal_code":"12345"}},
+				{"id":2,"full_name":"Bob","ssn":null,"age":40}]`,
+		},
+		{
+			name:   "select and NDJSON",
+			config: TransformConfig{Select: "data.users", Drop: []string{"ssn", "dob", "address", "age"}, Format: FormatNDJSON},
+			want:   "{\"id\":12345678901234567,\"name\":\"Ann\"}\n{\"id\":2,\"name\":\"Bob\"}\n",
+		},
+		{
+			name:   "select with a large integer that isn't compared",
+			config: TransformConfig{Select: "data.users[?age > `30`].id"},
+			want:   `[2]`,
+		},
+		{
+			name:   "select a large integer",
+			config: TransformConfig{Select: "data.users[?name == 'Ann'].id"},
+			want:   `[12345678901234567]`,
+		},
+		{
+			name:    "compare a large integer",
+			config:  TransformConfig{Select: "data.users[?id > `1`]"},
+			wantErr: "data contains integers too large to compare, such as 12345678901234567",
+		},
+		{
+			name:    "sort by a large integer",
+			config:  TransformConfig{Select: "sort_by(data.users, &id)"},
+			wantErr: "integers too large to compare",
+		},
+		{
+			name:    "bad format",
+			config:  TransformConfig{Format: "xml"},
+			wantErr: "unrecognized transform Format",
+		},
+		{
+			name:    "bad expression",
+			config:  TransformConfig{Select: "data.["},
+			wantErr: "invalid transform Select expression",
+		},
+		{
+			name:    "hash without a key",
+			config:  TransformConfig{Hash: []string{"ssn"}},
+			wantErr: "Hash requires a HashKey",
+		},
+		{
+			name:    "chained renames",
+			config:  TransformConfig{Rename: map[string]string{"address.zip": "code", "address.code": "postal_code"}},
+			wantErr: "conflicts with the Rename of 'address.code'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			err := tt.config.Validate()
+			if err == nil {
+				got, err = tt.config.Transform(strings.NewReader(data))
+			}
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tt.config.Format == FormatNDJSON {
+				require.Equal(t, tt.want, string(got))
+				return
+			}
+			require.JSONEq(t, tt.want, string(got))
+			require.NotContains(t, string(got), "12345678901234568", "large numbers should keep their precision")
+		})
+	}
+}
+
+func TestTransformConfig_Transform_LargeIDs(t *testing.T) {
+	data := `{"records":[{"id":9007199254740993},{"id":1}]}`
+
+	config := TransformConfig{Select: "records[?id > `1`]"}
+	require.NoError(t, config.Validate())
+	_, err := config.Transform(strings.NewReader(data))
+	require.Error(t, err, "a record must not be dropped because its ID can't be compared")
+	require.Contains(t, err.Error(), "9007199254740993")
+
+	config = TransformConfig{Select: "records[?id < `0`]"}
+	require.NoError(t, config.Validate())
+	got, err := config.Transform(strings.NewReader(data))
+	require.NoError(t, err)
+	require.JSONEq(t, `[]`, string(got))
+
+	config = TransformConfig{Select: "records[]"}
+	require.NoError(t, config.Validate())
+	got, err = config.Transform(strings.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, `[{"id":9007199254740993},{"id":1}]`, string(got))
+}
+
+func TestRunSet_Transform(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	source := &testSource{data: []byte(`{"users":[{"id":1,"ssn":"x"}]}`)}
+	destination := &testDestination{}
+	set := Set{Transform: &TransformConfig{Select: "users", Drop: []string{"ssn"}}}
+	require.NoError(t, set.Transform.Validate())
+
+	require.NoError(t, RunSet(logger, set, source, destination, nil, AppConfig{}))
+	require.Equal(t, `[{"id":1}]`, string(destination.written))
+}
+
+func TestOutputFormat_Convert(t *testing.T) {
+	input := `{"data":[{"id":1,"name":"Ann","address":{"city":"Paris"},"score":1.5,"active":true},` +
+		`{"id":2,"name":"Bob, Jr.","tags":["a"],"score":2}]}`
+
+	tests := []struct {
+		name    string
+		format  OutputFormat
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "inferred columns",
+			format: OutputFormat{Type: OutputFormatCSV, RecordsPath: "data"},
+			input:  input,
+			want: "active,address_city,id,name,score,tags\n" +
+				"true,Paris,1,Ann,1.5,\n" +
+				",,2,\"Bob, Jr.\",2,\"[\"\"a\"\"]\"\n",
+		},
+		{
+			name:   "inferred names made unique",
+			format: OutputFormat{Type: OutputFormatCSV},
+			input:  `[{"a":{"b":1},"a_b":2,"a_b_2":3}]`,
+			want:   "a_b,a_b_2,a_b_2_2\n1,2,3\n",
+		},
+		{
+			name: "declared columns",
+			format: OutputFormat{Type: OutputFormatCSV, RecordsPath: "data", Columns: []Column{
+				{Name: "id"}, {Name: "city", Path: "address.city"},
+			}},
+			input: input,
+			want:  "id,city\n1,Paris\n2,\n",
+		},
+		{
+			name:   "ndjson",
+			format: OutputFormat{Type: OutputFormatCSV},
+			input:  "{\"id\":1}\n{\"id\":2}\n",
+			want:   "id\n1\n2\n",
+		},
+		{
+			name:    "missing records",
+			format:  OutputFormat{Type: OutputFormatCSV, RecordsPath: "users"},
+			input:   input,
+			wantErr: "no records found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.format.Validate())
+			var buf bytes.Buffer
+			err := tt.format.Convert(&buf, strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, buf.String())
+		})
+	}
+
+	require.Error(t, (&OutputFormat{Type: "xml"}).Validate())
+	require.Error(t, (&OutputFormat{Type: OutputFormatCSV, Columns: []Column{{Name: "a", Type: "date"}}}).Validate())
+}
+
+func TestOutputFormat_ConvertParquet(t *testing.T) {
+	format := OutputFormat{Type: OutputFormatParquet, Columns: []Column{
+		{Name: "id", Type: ColumnTypeInt64},
+		{Name: "name"},
+		{Name: "created", Type: ColumnTypeTimestamp},
+	}}
+	require.NoError(t, format.Validate())
+	require.Equal(t, "parquet", format.Extension())
+
+	var buf bytes.Buffer
+	input := `[{"id":9007199254740993,"name":"Ann","created":"2021-03-04T05:06:07Z"},{"id":2}]`
+	require.NoError(t, format.Convert(&buf, strings.NewReader(input)))
+
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), file.NumRows())
+
+	rows := make([]parquet.Row, 2)
+	reader := parquet.NewReader(bytes.NewReader(buf.Bytes()))
+	n, _ := reader.ReadRows(rows)
+	require.Equal(t, 2, n)
+
+	// Columns are stored in name order: created, id, name
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	require.Equal(t, created.UnixMilli(), rows[0][0].Int64())
+	require.Equal(t, int64(9007199254740993), rows[0][1].Int64())
+	require.Equal(t, "Ann", rows[0][2].String())
+	require.True(t, rows[1][0].IsNull())
+	require.True(t, rows[1][2].IsNull())
+
+	require.Error(t, format.Convert(io.Discard, strings.NewReader(`[{"id":"x"}]`)))
+
+	// Inferred columns with the same name are written to separate columns
+	buf.Reset()
+	inferred := OutputFormat{Type: OutputFormatParquet}
+	require.NoError(t, inferred.Convert(&buf, strings.NewReader(`[{"a":{"b":1},"a_b":2}]`)))
+	file, err = parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, file.Schema().Fields(), 2)
+	n, _ = parquet.NewReader(bytes.NewReader(buf.Bytes())).ReadRows(rows)
+	require.Equal(t, 1, n)
+	require.Equal(t, int64(1), rows[0][0].Int64())
+	require.Equal(t, int64(2), rows[0][1].Int64())
+}
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("RDA_TEST_PASSWORD", "env-password")
+	secretFile := t.TempDir() + "/secret"
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0600))
+
+	config := `{"Source":{"AdapterConfig":{"BaseURL":"https://example.com","Password":"env:RDA_TEST_PASSWORD",` +
+		`"ClientSecret":"file:` + secretFile + `","BatchSize":10,"Headers":["plain:text"]}}}`
+	data, err := ResolveSecrets([]byte(config))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Source":{"AdapterConfig":{"BaseURL":"https://example.com","Password":"env-password",`+
+		`"ClientSecret":"file-secret","BatchSize":10,"Headers":["plain:text"]}}}`, string(data))
+
+	unchanged := []byte(`{"BaseURL": "https://example.com"}`)
+	data, err = ResolveSecrets(unchanged)
+	require.NoError(t, err)
+	require.Equal(t, unchanged, data)
+
+	_, err = ResolveSecrets([]byte(`{"Password":"env:RDA_TEST_MISSING"}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "env:RDA_TEST_MISSING")
+
+	var buf bytes.Buffer
+	logger := log.New(NewRedactingWriter(&buf), "", 0)
+	logger.Printf("login with env-password failed, token file-secret")
+	require.Equal(t, "login with [REDACTED] failed, token [REDACTED]\n", buf.String())
+}
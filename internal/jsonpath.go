@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GetJSONPath returns the value found at a simple JSON path within a document decoded by
+// encoding/json. The path is a dot-separated list of object keys and array indexes, with an
+// optional leading "$", for example "$.paging.next" or "records.0.Name". An empty path (or "$")
+// returns the document itself.
+func GetJSONPath(doc interface{}, path string) (interface{}, bool) {
+	current := doc
+	for _, key := range SplitJSONPath(path) {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// GetRawJSONPath returns the value found at a JSON path within the JSON data, as in GetJSONPath,
+// without decoding it, so that it is exactly as it appears in the data
+func GetRawJSONPath(data []byte, path string) (json.RawMessage, bool) {
+	current := json.RawMessage(data)
+	for _, key := range SplitJSONPath(path) {
+		trimmed := bytes.TrimSpace(current)
+		if len(trimmed) == 0 {
+			return nil, false
+		}
+		switch trimmed[0] {
+		case '{':
+			var node map[string]json.RawMessage
+			if err := json.Unmarshal(trimmed, &node); err != nil {
+				return nil, false
+			}
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case '[':
+			var node []json.RawMessage
+			if err := json.Unmarshal(trimmed, &node); err != nil {
+				return nil, false
+			}
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// GetJSONPathString returns the value at a JSON path as a string. Numbers and booleans are
+// formatted, and missing or null values result in an empty string.
+func GetJSONPathString(doc interface{}, path string) string {
+	value, ok := GetJSONPath(doc, path)
+	if !ok || value == nil {
+		return ""
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// SplitJSONPath returns the keys and array indexes of a path as used by GetJSONPath
+func SplitJSONPath(path string) []string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil
+	}
+
+	// accept bracketed array indexes, e.g. "records[0].Name"
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	return strings.Split(path, ".")
+}
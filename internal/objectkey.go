@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Object key template variables
+const (
+	KeyVarSet       = "set"
+	KeyVarRunID     = "run_id"
+	KeyVarYear      = "yyyy"
+	KeyVarMonth     = "mm"
+	KeyVarDay       = "dd"
+	KeyVarHour      = "hh"
+	KeyVarTimestamp = "timestamp"
+	KeyVarHash      = "hash"
+	KeyVarExt       = "ext"
+)
+
+// timestampLayouts are the named layouts accepted in a "{timestamp:<layout>}" variable. Any
+// other value is used as a Go time layout.
+var timestampLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Compact":     "20060102T150405Z",
+}
+
+// ObjectKeyTemplate builds object keys from a template such as
+// "{set}/year={yyyy}/month={mm}/day={dd}/{set}_{timestamp:RFC3339}.{ext}". Variables are:
+//
+//	{set}                 set name
+//	{run_id}              ID of the current run, shared by all sets
+//	{yyyy} {mm} {dd} {hh} UTC date parts
+//	{timestamp}           Unix time in nanoseconds
+//	{timestamp:<layout>}  UTC time formatted with RFC3339, RFC3339Nano, Unix, UnixNano, Compact,
+//	                      or a Go time layout
+//	{hash}                hex-encoded SHA-256 hash of the content
+//	{ext}                 file name extension without the leading ".", e.g. "json" or "json.gz"
+type ObjectKeyTemplate struct {
+	parts []keyTemplatePart
+}
+
+type keyTemplatePart struct {
+	literal  string
+	variable string
+	arg      string
+}
+
+// ObjectKeyValues are the values substituted into an ObjectKeyTemplate
+type ObjectKeyValues struct {
+	SetName string
+	RunID   string
+	Time    time.Time
+	Hash    string
+	Ext     string
+}
+
+// ParseObjectKeyTemplate parses and validates an object key template
+func ParseObjectKeyTemplate(template string) (ObjectKeyTemplate, error) {
+	var t ObjectKeyTemplate
+	rest := template
+	for rest != "" {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			if strings.Contains(rest, "}") {
+				return t, fmt.Errorf("unmatched '}' in object key template '%s'", template)
+			}
+			t.parts = append(t.parts, keyTemplatePart{literal: rest})
+			break
+		}
+		if strings.Contains(rest[:open], "}") {
+			return t, fmt.Errorf("unmatched '}' in object key template '%s'", template)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, keyTemplatePart{literal: rest[:open]})
+		}
+
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return t, fmt.Errorf("unclosed '{' in object key template '%s'", template)
+		}
+		name, arg, _ := strings.Cut(rest[open+1:open+end], ":")
+		if err := validateKeyVariable(name, arg); err != nil {
+			return t, fmt.Errorf("%s in object key template '%s'", err, template)
+		}
+		t.parts = append(t.parts, keyTemplatePart{variable: name, arg: arg})
+		rest = rest[open+end+1:]
+	}
+
+	if len(t.parts) == 0 {
+		return t, fmt.Errorf("object key template is empty")
+	}
+	return t, nil
+}
+
+func validateKeyVariable(name, arg string) error {
+	switch name {
+	case KeyVarTimestamp:
+		return nil
+	case KeyVarSet, KeyVarRunID, KeyVarYear, KeyVarMonth, KeyVarDay, KeyVarHour, KeyVarHash, KeyVarExt:
+		if arg != "" {
+			return fmt.Errorf("variable '{%s}' does not take an argument", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unrecognized variable '{%s}'", name)
+}
+
+// Uses returns true if the template contains the given variable
+func (t ObjectKeyTemplate) Uses(variable string) bool {
+	for _, p := range t.parts {
+		if p.variable == variable {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute returns the object key with the variables replaced by the given values
+func (t ObjectKeyTemplate) Execute(values ObjectKeyValues) string {
+	now := values.Time.UTC()
+	var sb strings.Builder
+	for _, p := range t.parts {
+		switch p.variable {
+		case "":
+			sb.WriteString(p.literal)
+		case KeyVarSet:
+			sb.WriteString(values.SetName)
+		case KeyVarRunID:
+			sb.WriteString(values.RunID)
+		case KeyVarYear:
+			sb.WriteString(now.Format("2006"))
+		case KeyVarMonth:
+			sb.WriteString(now.Format("01"))
+		case KeyVarDay:
+			sb.WriteString(now.Format("02"))
+		case KeyVarHour:
+			sb.WriteString(now.Format("15"))
+		case KeyVarTimestamp:
+			sb.WriteString(formatTimestamp(now, p.arg))
+		case KeyVarHash:
+			sb.WriteString(values.Hash)
+		case KeyVarExt:
+			sb.WriteString(values.Ext)
+		}
+	}
+	return sb.String()
+}
+
+// StaticPrefix returns the part of the key that is the same for every object of the set, i.e.
+// everything before the first variable other than {set}
+func (t ObjectKeyTemplate) StaticPrefix(setName string) string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		switch p.variable {
+		case "":
+			sb.WriteString(p.literal)
+		case KeyVarSet:
+			sb.WriteString(setName)
+		default:
+			return sb.String()
+		}
+	}
+	return sb.String()
+}
+
+// Pattern returns a regular expression, without anchors, that matches the keys the template
+// produces for the set, so that the objects of one set can be told apart from those of another
+func (t ObjectKeyTemplate) Pattern(setName string) string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		switch p.variable {
+		case "":
+			sb.WriteString(regexp.QuoteMeta(p.literal))
+		case KeyVarSet:
+			sb.WriteString(regexp.QuoteMeta(setName))
+		case KeyVarRunID:
+			sb.WriteString(`\d{8}T\d{6}Z-[0-9a-f]{8}`)
+		case KeyVarYear:
+			sb.WriteString(`\d{4}`)
+		case KeyVarMonth, KeyVarDay, KeyVarHour:
+			sb.WriteString(`\d{2}`)
+		case KeyVarTimestamp:
+			sb.WriteString(timestampPattern(p.arg))
+		case KeyVarHash:
+			sb.WriteString(`[0-9a-f]{64}`)
+		case KeyVarExt:
+			sb.WriteString(ExtensionPattern)
+		}
+	}
+	return sb.String()
+}
+
+// ExtensionPattern is a regular expression that matches a file name extension without the
+// leading ".", such as "json" or "csv.gz"
+const ExtensionPattern = `[A-Za-z0-9]+(\.[A-Za-z0-9]+)*`
+
+// timestampPattern returns a regular expression that matches a timestamp formatted by
+// formatTimestamp with the layout. Runs of digits and of letters in a formatted time are matched
+// by any digits and any letters, and a time is formatted with and without fractional seconds,
+// which some layouts omit when they are zero.
+func timestampPattern(layout string) string {
+	switch layout {
+	case "", "UnixNano", "Unix":
+		return `\d+`
+	}
+
+	var patterns []string
+	for _, nsec := range []int{0, 123456789} {
+		sample := formatTimestamp(time.Date(2001, 2, 3, 4, 5, 6, nsec, time.UTC), layout)
+		var sb strings.Builder
+		for i := 0; i < len(sample); {
+			j := i + 1
+			switch {
+			case isDigit(sample[i]):
+				for j < len(sample) && isDigit(sample[j]) {
+					j++
+				}
+				sb.WriteString(`\d+`)
+			case isLetter(sample[i]):
+				for j < len(sample) && isLetter(sample[j]) {
+					j++
+				}
+				sb.WriteString(`[A-Za-z]+`)
+			default:
+				sb.WriteString(regexp.QuoteMeta(sample[i:j]))
+			}
+			i = j
+		}
+		patterns = append(patterns, sb.String())
+	}
+	if patterns[0] == patterns[1] {
+		return patterns[0]
+	}
+	return "(?:" + strings.Join(patterns, "|") + ")"
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func formatTimestamp(t time.Time, layout string) string {
+	switch layout {
+	case "", "UnixNano":
+		return strconv.FormatInt(t.UnixNano(), 10)
+	case "Unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	if named, ok := timestampLayouts[layout]; ok {
+		layout = named
+	}
+	return t.Format(layout)
+}
+
+// NewRunID returns an ID for a run, made of the UTC start time and a random suffix
+func NewRunID(start time.Time) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
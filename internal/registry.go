@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// SourceFactory creates a Source from the source configuration
+type SourceFactory func(sourceConfig SourceConfig) (Source, error)
+
+// DestinationFactory creates a Destination from the destination configuration
+type DestinationFactory func(destinationConfig DestinationConfig) (Destination, error)
+
+// StateStoreFactory creates a StateStore from the state configuration
+type StateStoreFactory func(stateConfig StateConfig) (StateStore, error)
+
+var (
+	registryMutex        sync.RWMutex
+	sourceFactories      = map[string]SourceFactory{}
+	destinationFactories = map[string]DestinationFactory{}
+	stateStoreFactories  = map[string]StateStoreFactory{}
+	secretResolvers      = map[string]SecretResolver{}
+)
+
+// RegisterSource makes a source adapter available by the given type name. Adapters normally
+// register themselves from an init function. It panics if the type is already registered or
+// if the factory is nil.
+func RegisterSource(sourceType string, factory SourceFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("RegisterSource factory is nil for type " + sourceType)
+	}
+	if _, exists := sourceFactories[sourceType]; exists {
+		panic("RegisterSource called twice for type " + sourceType)
+	}
+	sourceFactories[sourceType] = factory
+}
+
+// RegisterDestination makes a destination adapter available by the given type name. Adapters
+// normally register themselves from an init function. It panics if the type is already
+// registered or if the factory is nil.
+func RegisterDestination(destinationType string, factory DestinationFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("RegisterDestination factory is nil for type " + destinationType)
+	}
+	if _, exists := destinationFactories[destinationType]; exists {
+		panic("RegisterDestination called twice for type " + destinationType)
+	}
+	destinationFactories[destinationType] = factory
+}
+
+// RegisterStateStore makes a state store available by the given type name. It panics if the
+// type is already registered or if the factory is nil.
+func RegisterStateStore(stateStoreType string, factory StateStoreFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if factory == nil {
+		panic("RegisterStateStore factory is nil for type " + stateStoreType)
+	}
+	if _, exists := stateStoreFactories[stateStoreType]; exists {
+		panic("RegisterStateStore called twice for type " + stateStoreType)
+	}
+	stateStoreFactories[stateStoreType] = factory
+}
+
+// NewSource creates a Source using the factory registered for the configured type
+func NewSource(sourceConfig SourceConfig) (Source, error) {
+	registryMutex.RLock()
+	factory, ok := sourceFactories[sourceConfig.Type]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unrecognized source type, available types: %v", SourceTypes())
+	}
+	return factory(sourceConfig)
+}
+
+// NewDestination creates a Destination using the factory registered for the configured type
+func NewDestination(destinationConfig DestinationConfig) (Destination, error) {
+	registryMutex.RLock()
+	factory, ok := destinationFactories[destinationConfig.Type]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unrecognized destination type, available types: %v", DestinationTypes())
+	}
+	return factory(destinationConfig)
+}
+
+// SourceTypes returns the sorted names of the registered source types
+func SourceTypes() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]string, 0, len(sourceFactories))
+	for t := range sourceFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// DestinationTypes returns the sorted names of the registered destination types
+func DestinationTypes() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]string, 0, len(destinationFactories))
+	for t := range destinationFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewStateStore creates a StateStore using the factory registered for the configured type. If no
+// type is configured, it returns nil and state is not kept between runs.
+func NewStateStore(stateConfig StateConfig) (StateStore, error) {
+	if stateConfig.Type == "" {
+		return nil, nil
+	}
+
+	registryMutex.RLock()
+	factory, ok := stateStoreFactories[stateConfig.Type]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unrecognized state store type, available types: %v", StateStoreTypes())
+	}
+	return factory(stateConfig)
+}
+
+// StateStoreTypes returns the sorted names of the registered state store types
+func StateStoreTypes() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]string, 0, len(stateStoreFactories))
+	for t := range stateStoreFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// RegisterSecretResolver makes a SecretResolver available for config values beginning with the
+// given scheme followed by a colon, such as "ssm:". It panics if the scheme is already registered
+// or if the resolver is nil.
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if resolver == nil {
+		panic("RegisterSecretResolver resolver is nil for scheme " + scheme)
+	}
+	if _, exists := secretResolvers[scheme]; exists {
+		panic("RegisterSecretResolver called twice for scheme " + scheme)
+	}
+	secretResolvers[scheme] = resolver
+}
+
+// secretResolver returns the SecretResolver registered for the scheme, or nil if there is none
+func secretResolver(scheme string) SecretResolver {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return secretResolvers[scheme]
+}
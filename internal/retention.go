@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy determines which archives of a set are kept. An archive is kept if any of the
+// rules would keep it. A policy with no rules keeps everything.
+type RetentionPolicy struct {
+	// KeepLast keeps the given number of most recent archives
+	KeepLast int
+
+	// KeepDays keeps archives created within the given number of days
+	KeepDays int
+
+	// KeepDaily, KeepWeekly and KeepMonthly keep the most recent archive of each of the given
+	// number of most recent days, ISO weeks and months that have archives (grandfather-father-son)
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+// ArchivedObject identifies an existing archive and when it was created
+type ArchivedObject struct {
+	Key      string
+	Modified time.Time
+}
+
+// IsEmpty returns true if the policy has no rules
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.KeepLast == 0 && p.KeepDays == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0
+}
+
+// Validate returns an error if any of the rules are negative
+func (p RetentionPolicy) Validate() error {
+	if p.KeepLast < 0 || p.KeepDays < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 {
+		return fmt.Errorf("retention policy values must not be negative")
+	}
+	return nil
+}
+
+// Expired returns the keys of the objects that are not kept by the policy, oldest first
+func (p RetentionPolicy) Expired(objects []ArchivedObject, now time.Time) []string {
+	if p.IsEmpty() {
+		return nil
+	}
+
+	sorted := make([]ArchivedObject, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Modified.After(sorted[j].Modified)
+	})
+
+	keep := map[string]bool{}
+	for i, o := range sorted {
+		if i < p.KeepLast {
+			keep[o.Key] = true
+		}
+		if p.KeepDays > 0 && o.Modified.After(now.AddDate(0, 0, -p.KeepDays)) {
+			keep[o.Key] = true
+		}
+	}
+
+	keepPeriods(sorted, keep, p.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(sorted, keep, p.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPeriods(sorted, keep, p.KeepMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	var expired []string
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if !keep[sorted[i].Key] {
+			expired = append(expired, sorted[i].Key)
+		}
+	}
+	return expired
+}
+
+// keepPeriods marks the newest object in each of the n most recent periods as kept. The objects
+// must be sorted newest first.
+func keepPeriods(sorted []ArchivedObject, keep map[string]bool, n int, period func(time.Time) string) {
+	seen := map[string]bool{}
+	for _, o := range sorted {
+		if len(seen) >= n {
+			return
+		}
+		p := period(o.Modified.UTC())
+		if !seen[p] {
+			seen[p] = true
+			keep[o.Key] = true
+		}
+	}
+}
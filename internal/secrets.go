@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	SecretSchemeEnv  = "env"
+	SecretSchemeFile = "file"
+
+	// RedactedText replaces secret values in log output
+	RedactedText = "[REDACTED]"
+
+	// minRedactedLength is the shortest secret value that is redacted from log output. Shorter
+	// values would redact unrelated text.
+	minRedactedLength = 4
+)
+
+// SecretResolver returns the value of a secret given its reference, the part of a config value
+// after the scheme and colon. For example, the reference of "env:API_PASSWORD" is "API_PASSWORD".
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretResolverFunc is a function that implements SecretResolver
+type SecretResolverFunc func(ref string) (string, error)
+
+// Resolve calls the function
+func (f SecretResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	secretsMutex sync.RWMutex
+	secretValues []string
+)
+
+func init() {
+	RegisterSecretResolver(SecretSchemeEnv, SecretResolverFunc(resolveEnv))
+	RegisterSecretResolver(SecretSchemeFile, SecretResolverFunc(resolveFile))
+}
+
+func resolveEnv(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+// resolveFile returns the contents of the file, without a trailing line break
+func resolveFile(ref string) (string, error) {
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// ResolveSecrets replaces each string in the JSON config data that begins with the scheme of a
+// registered SecretResolver, such as "env:API_PASSWORD", with the value of the secret. Resolved
+// values are redacted by RedactSecrets.
+func ResolveSecrets(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	resolved := false
+	doc, err := resolveSecretValues(doc, &resolved)
+	if err != nil || !resolved {
+		return data, err
+	}
+	return marshalRecord(doc)
+}
+
+func resolveSecretValues(value interface{}, resolved *bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		scheme, ref, ok := strings.Cut(v, ":")
+		if !ok {
+			return v, nil
+		}
+		resolver := secretResolver(scheme)
+		if resolver == nil {
+			return v, nil
+		}
+		secret, err := resolver.Resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve secret '%s': %s", v, err)
+		}
+		AddSecret(secret)
+		*resolved = true
+		return secret, nil
+
+	case []interface{}:
+		for i := range v {
+			var err error
+			if v[i], err = resolveSecretValues(v[i], resolved); err != nil {
+				return nil, err
+			}
+		}
+
+	case map[string]interface{}:
+		for k := range v {
+			var err error
+			if v[k], err = resolveSecretValues(v[k], resolved); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+// AddSecret adds a value to be redacted from log output
+func AddSecret(value string) {
+	if len(value) < minRedactedLength {
+		return
+	}
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	for _, v := range secretValues {
+		if v == value {
+			return
+		}
+	}
+	secretValues = append(secretValues, value)
+
+	// Redact longer values first, in case one secret contains another
+	sort.Slice(secretValues, func(i, j int) bool {
+		return len(secretValues[i]) > len(secretValues[j])
+	})
+}
+
+// RedactSecrets returns the text with each secret value replaced by RedactedText
+func RedactSecrets(text string) string {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	for _, value := range secretValues {
+		text = strings.ReplaceAll(text, value, RedactedText)
+	}
+	return text
+}
+
+// RedactingWriter is an io.Writer that removes secret values from the text written to it. Each
+// Write should contain whole lines, as written by a log.Logger.
+type RedactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer that redacts secret values before writing to w
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	return &RedactingWriter{w: w}
+}
+
+// Write writes p to the underlying writer with secret values redacted
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, RedactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
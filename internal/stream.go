@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// AsStreamSource returns the source as a StreamSource. If the source does not implement
+// StreamSource, its Read output is wrapped in a reader.
+func AsStreamSource(source Source) StreamSource {
+	if s, ok := source.(StreamSource); ok {
+		return s
+	}
+	return &streamSourceShim{Source: source}
+}
+
+// AsStreamDestination returns the destination as a StreamDestination. If the destination does
+// not implement StreamDestination, the stream is read into memory and passed to Write.
+func AsStreamDestination(destination Destination) StreamDestination {
+	if d, ok := destination.(StreamDestination); ok {
+		return d
+	}
+	return &streamDestinationShim{Destination: destination}
+}
+
+type streamSourceShim struct {
+	Source
+}
+
+func (s *streamSourceShim) ReadStream() (io.ReadCloser, error) {
+	data, err := s.Source.Read()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+type streamDestinationShim struct {
+	Destination
+}
+
+func (d *streamDestinationShim) WriteStream(data io.Reader, activityLog chan<- EventLogItem) error {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	return d.Destination.Write(b, activityLog)
+}
+
+// SpooledFile is a temporary file holding data that must be read in full before it is used,
+// for example to compute its hash. Close removes the file.
+type SpooledFile struct {
+	*os.File
+
+	// Hash is the hex-encoded SHA-256 hash of the data
+	Hash string
+
+	// Size is the length of the data in bytes
+	Size int64
+}
+
+// Spool copies data to a temporary file, computing its hash along the way, and returns the file
+// positioned at the beginning of the data. The caller must close the returned file.
+func Spool(data io.Reader) (*SpooledFile, error) {
+	f, err := os.CreateTemp("", "rda-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &SpooledFile{File: f}
+
+	hash := sha256.New()
+	spooled.Size, err = io.Copy(io.MultiWriter(f, hash), data)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = spooled.Close()
+		return nil, err
+	}
+
+	spooled.Hash = hex.EncodeToString(hash.Sum(nil))
+	return spooled, nil
+}
+
+// Close closes and removes the temporary file
+func (f *SpooledFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errorRecordingReader records the first error, other than io.EOF, returned by the underlying
+// reader, so that it can be told apart from an error of the code reading from it. Errors are
+// returned as a SourceReadError.
+type errorRecordingReader struct {
+	io.Reader
+	err error
+}
+
+func (e *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		if e.err == nil {
+			e.err = err
+		}
+		err = &SourceReadError{Err: err}
+	}
+	return n, err
+}
+
+// SourceReadError is an error reading the source's data, returned to the destination by the data
+// reader. RunSet reports it as a failure of the source, so a destination should return it without
+// sending an alert of its own.
+type SourceReadError struct {
+	Err error
+}
+
+func (e *SourceReadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SourceReadError) Unwrap() error {
+	return e.Err
+}
+
+// IsSourceReadError returns true if the error is, or was caused by, a SourceReadError. Besides
+// wrapped errors, it follows errors that give their cause with an OrigErr method, such as those
+// of the AWS SDK.
+func IsSourceReadError(err error) bool {
+	for err != nil {
+		if _, ok := err.(*SourceReadError); ok {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ OrigErr() error }:
+			err = e.OrigErr()
+		default:
+			return false
+		}
+	}
+	return false
+}
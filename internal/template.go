@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateData is the data available to the templates in a set's configuration, for example
+// "{{ .LastRunTime | default (.Now | add \"-24h\") | date \"RFC3339\" }}"
+type TemplateData struct {
+	// Now is the time the set's run started
+	Now time.Time
+
+	// LastRunTime is the start time of the last successful run of the set, or the zero time if
+	// there is none or no state store is configured
+	LastRunTime time.Time
+
+	// Watermark is the high-water mark saved by the last successful run of the set, or an empty
+	// string if there is none
+	Watermark string
+
+	// SetName is the name of the set
+	SetName string
+
+	// RunID identifies the run. It is only available in destination templates.
+	RunID string
+
+	// ContentHash is the hex SHA-256 hash of the data written. It is only available in
+	// destination templates.
+	ContentHash string
+
+	// Source is the metadata reported by a MetadataSource, such as the RestAPI "SourceURL". It is
+	// only available in destination templates, and is empty if the source reports no metadata.
+	Source map[string]string
+}
+
+// templateFuncs are the functions available in templates, in addition to the text/template
+// built-in functions:
+//
+//	date LAYOUT TIME      formats the time in UTC. LAYOUT is "Unix", "UnixNano", "RFC3339",
+//	                      "RFC3339Nano", "Compact" or a Go time layout
+//	add DURATION TIME     adds a duration such as "-24h" or "-7d" to the time
+//	default DEFAULT VALUE returns DEFAULT if VALUE is a zero value, such as a zero time
+//	env NAME              returns the value of the environment variable
+var templateFuncs = template.FuncMap{
+	"date": func(layout string, t time.Time) string {
+		return formatTimestamp(t.UTC(), layout)
+	},
+	"add": func(duration string, t time.Time) (time.Time, error) {
+		d, err := parseDuration(duration)
+		if err != nil {
+			return t, err
+		}
+		return t.Add(d), nil
+	},
+	"default": func(def, value interface{}) interface{} {
+		if value == nil || reflect.ValueOf(value).IsZero() {
+			return def
+		}
+		return value
+	},
+	"env": os.Getenv,
+}
+
+// RenderTemplate executes the template text with the given data. Text without "{{" is returned
+// unchanged.
+func RenderTemplate(text string, data TemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	// Missing map keys, such as a .Source value that the source doesn't report, render as empty
+	tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template '%s': %s", text, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error in template '%s': %s", text, err)
+	}
+	return buf.String(), nil
+}
+
+// RenderTemplates renders the templates in all of the strings of a decoded JSON value
+func RenderTemplates(value interface{}, data TemplateData) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return RenderTemplate(v, data)
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i := range v {
+			r, err := RenderTemplates(v[i], data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for k := range v {
+			r, err := RenderTemplates(v[k], data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[k] = r
+		}
+		return rendered, nil
+	}
+	return value, nil
+}
+
+// parseDuration parses a Go duration, or a whole number of days such as "-7d"
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+// TransformConfig configures changes made to a set's data before it is archived. The steps are
+// applied in the order of the fields. Field paths are dotted paths of object keys within each
+// record, such as "person.ssn".
+type TransformConfig struct {
+	// Select is a JMESPath expression that selects the records, such as "data.users[]". If the
+	// result is not an array, it is treated as a single record.
+	Select string
+
+	// Drop removes the fields from each record
+	Drop []string
+
+	// Hash replaces the values of the fields with their hex HMAC-SHA256, keyed by HashKey, so that
+	// records can still be matched without revealing the values. HashKey is required with Hash,
+	// and should be a long random secret, since a value such as a birthdate could otherwise be
+	// found by hashing every possible value.
+	Hash    []string
+	HashKey string
+
+	// Rename renames fields, from their path to a new key in the same object. The fields are
+	// renamed in the order of their paths, and a field can't be renamed to a field that is also
+	// renamed.
+	Rename map[string]string
+
+	// Format is "json" (default), a JSON array of the records, or "ndjson", one record per line
+	Format string
+
+	selectExpr *jmespath.JMESPath
+}
+
+// Validate checks the configuration and compiles the Select expression
+func (t *TransformConfig) Validate() error {
+	switch t.Format {
+	case "", FormatJSON, FormatNDJSON:
+	default:
+		return fmt.Errorf("unrecognized transform Format '%s'", t.Format)
+	}
+
+	if t.Select != "" {
+		expr, err := jmespath.Compile(t.Select)
+		if err != nil {
+			return fmt.Errorf("invalid transform Select expression '%s': %s", t.Select, err)
+		}
+		t.selectExpr = expr
+	}
+
+	for _, path := range append(append([]string{}, t.Drop...), t.Hash...) {
+		if path == "" {
+			return fmt.Errorf("transform field paths must not be empty")
+		}
+	}
+	if len(t.Hash) > 0 && t.HashKey == "" {
+		return fmt.Errorf("transform Hash requires a HashKey")
+	}
+
+	for from, to := range t.Rename {
+		if from == "" || to == "" {
+			return fmt.Errorf("transform Rename field names must not be empty")
+		}
+		// The renamed field is in the same object as the original
+		renamed := to
+		if i := strings.LastIndex(from, "."); i >= 0 {
+			renamed = from[:i+1] + to
+		}
+		if _, chained := t.Rename[renamed]; chained && renamed != from {
+			return fmt.Errorf("transform Rename of '%s' to '%s' conflicts with the Rename of '%s'", from, to, renamed)
+		}
+	}
+	return nil
+}
+
+// renamePaths returns the paths of the fields to rename, in order
+func (t *TransformConfig) renamePaths() []string {
+	paths := make([]string, 0, len(t.Rename))
+	for from := range t.Rename {
+		paths = append(paths, from)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Transform reads the data and returns the transformed data
+func (t *TransformConfig) Transform(data io.Reader) ([]byte, error) {
+	if t.Select != "" && t.selectExpr == nil {
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("unable to transform data that is not valid JSON: %s", err)
+	}
+
+	if t.selectExpr != nil {
+		if doc, err = t.selectRecords(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	records, isArray := doc.([]interface{})
+	if !isArray {
+		records = []interface{}{doc}
+	}
+
+	for _, record := range records {
+		for _, path := range t.Drop {
+			editField(record, path, func(parent map[string]interface{}, key string) {
+				delete(parent, key)
+			})
+		}
+		for _, path := range t.Hash {
+			editField(record, path, func(parent map[string]interface{}, key string) {
+				parent[key] = t.hash(parent[key])
+			})
+		}
+		for _, from := range t.renamePaths() {
+			to := t.Rename[from]
+			editField(record, from, func(parent map[string]interface{}, key string) {
+				value := parent[key]
+				delete(parent, key)
+				parent[to] = value
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if t.Format == FormatNDJSON {
+		w := bufio.NewWriter(&buf)
+		for _, record := range records {
+			line, err := marshalRecord(record)
+			if err != nil {
+				return nil, err
+			}
+			_, _ = w.Write(line)
+			_ = w.WriteByte('\n')
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	if !isArray {
+		return marshalRecord(doc)
+	}
+	return marshalRecord(records)
+}
+
+// hash returns the hex HMAC-SHA256 of the value, keyed by the HashKey. Strings are hashed as they
+// are and other values as JSON. Null values are left as null.
+func (t *TransformConfig) hash(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		b, _ := json.Marshal(value)
+		s = string(b)
+	}
+	mac := hmac.New(sha256.New, []byte(t.HashKey))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// editField calls edit with the object containing the field at the dotted path, if it exists
+func editField(record interface{}, path string, edit func(parent map[string]interface{}, key string)) {
+	keys := strings.Split(path, ".")
+	parent, ok := record.(map[string]interface{})
+	for _, key := range keys[:len(keys)-1] {
+		if !ok {
+			return
+		}
+		parent, ok = parent[key].(map[string]interface{})
+	}
+	if !ok {
+		return
+	}
+	if _, exists := parent[keys[len(keys)-1]]; exists {
+		edit(parent, keys[len(keys)-1])
+	}
+}
+
+// marshalRecord encodes the value as JSON without escaping HTML characters
+func marshalRecord(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// maxExactFloatInt is the largest integer that a float64 represents exactly
+const maxExactFloatInt = 1 << 53
+
+// selectRecords evaluates the Select expression. Numbers are converted to float64 for JMESPath,
+// except integers too large to be exact as a float64, which are kept as they are so that large
+// IDs don't lose precision, but which JMESPath can't compare. If the data has such integers, the
+// expression is also evaluated with them approximated as float64, and an error is returned if
+// the results differ, so that a comparison of them can't silently drop records.
+func (t *TransformConfig) selectRecords(doc interface{}) (interface{}, error) {
+	var inexact string
+	result, err := t.selectExpr.Search(jmespathNumbers(doc, false, &inexact))
+	if inexact != "" {
+		approximate, approximateErr := t.selectExpr.Search(jmespathNumbers(doc, true, nil))
+		if (err == nil) != (approximateErr == nil) || (err == nil && !sameJMESPathResult(result, approximate)) {
+			return nil, fmt.Errorf("the transform Select expression can't be evaluated exactly, as the data "+
+				"contains integers too large to compare, such as %s", inexact)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in transform Select expression: %s", err)
+	}
+	return result, nil
+}
+
+// jmespathNumbers returns a copy of the value with the numbers converted to float64, as required
+// by JMESPath comparisons and functions. Integers too large to be exact as a float64 are kept as
+// they are, and the first is saved in inexact, unless approximate is true.
+func jmespathNumbers(value interface{}, approximate bool, inexact *string) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if !approximate && !strings.ContainsAny(v.String(), ".eE") {
+			i, err := v.Int64()
+			if err != nil || i > maxExactFloatInt || i < -maxExactFloatInt {
+				if *inexact == "" {
+					*inexact = v.String()
+				}
+				return v
+			}
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i := range v {
+			converted[i] = jmespathNumbers(v[i], approximate, inexact)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for k := range v {
+			converted[k] = jmespathNumbers(v[k], approximate, inexact)
+		}
+		return converted
+	}
+	return value
+}
+
+// sameJMESPathResult returns true if the result of an expression, evaluated with large integers
+// kept as they are, matches the result with them approximated as float64
+func sameJMESPathResult(exact, approximate interface{}) bool {
+	switch v := exact.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		a, ok := approximate.(float64)
+		return err == nil && ok && f == a
+	case []interface{}:
+		a, ok := approximate.([]interface{})
+		if !ok || len(a) != len(v) {
+			return false
+		}
+		for i := range v {
+			if !sameJMESPathResult(v[i], a[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		a, ok := approximate.(map[string]interface{})
+		if !ok || len(a) != len(v) {
+			return false
+		}
+		for k := range v {
+			if _, ok := a[k]; !ok || !sameJMESPathResult(v[k], a[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(exact, approximate)
+}
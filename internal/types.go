@@ -2,7 +2,10 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log/syslog"
+	"time"
 
 	"github.com/silinternational/rest-data-archiver/alert"
 )
@@ -10,15 +13,35 @@ import (
 type SourceConfig struct {
 	Type          string
 	AdapterConfig json.RawMessage
+
+	// HasStateStore is true if a State store is configured, and DryRunMode is the Runtime setting.
+	// They are assigned at runtime, not read from the config.
+	HasStateStore bool `json:"-"`
+	DryRunMode    bool `json:"-"`
 }
 
 type DestinationConfig struct {
 	Type          string
 	AdapterConfig json.RawMessage
+
+	// RunID identifies the current run. It is assigned at runtime, not read from the config.
+	RunID string `json:"-"`
+}
+
+type StateConfig struct {
+	Type          string
+	AdapterConfig json.RawMessage
 }
 
 type RuntimeConfig struct {
 	DryRunMode bool
+
+	// Concurrency is the number of sets processed in parallel. Default: 1
+	Concurrency int
+
+	// SkipIfUnchanged skips writing a set's data if it is identical to the last archive. It
+	// requires a destination that implements ChangeDetector.
+	SkipIfUnchanged bool
 }
 
 type AppConfig struct {
@@ -26,6 +49,8 @@ type AppConfig struct {
 	Source      SourceConfig
 	Destination DestinationConfig
 	Alert       alert.Config
+	Encryption  EncryptionConfig
+	State       StateConfig
 	Sets        []Set
 }
 
@@ -33,6 +58,12 @@ type Set struct {
 	Name        string
 	Source      json.RawMessage
 	Destination json.RawMessage
+
+	// SkipIfUnchanged overrides the Runtime SkipIfUnchanged setting for this set
+	SkipIfUnchanged *bool
+
+	// Transform changes the data before it is archived
+	Transform *TransformConfig
 }
 
 type EventLogItem struct {
@@ -44,6 +75,26 @@ func (l EventLogItem) String() string {
 	return LogLevels[l.Level] + ": " + l.Message
 }
 
+// AlertedError is an error that has already been reported as a LOG_ALERT event, so that it is
+// not sent as an alert again when it is returned
+type AlertedError struct {
+	Err error
+}
+
+func (e *AlertedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AlertedError) Unwrap() error {
+	return e.Err
+}
+
+// IsAlerted returns true if the error, or an error it wraps, is an AlertedError
+func IsAlerted(err error) bool {
+	var alerted *AlertedError
+	return errors.As(err, &alerted)
+}
+
 var LogLevels = map[syslog.Priority]string{
 	syslog.LOG_EMERG:   "Emerg",
 	syslog.LOG_ALERT:   "Alert",
@@ -55,12 +106,121 @@ var LogLevels = map[syslog.Priority]string{
 	syslog.LOG_DEBUG:   "Debug",
 }
 
+// Destination writes data to an archive. ForSet returns a new instance configured for the
+// given set, leaving the receiver unchanged so that sets can be processed concurrently.
 type Destination interface {
-	ForSet(setName string, setJson json.RawMessage) error
+	ForSet(setName string, setJson json.RawMessage) (Destination, error)
 	Write(data []byte, activityLog chan<- EventLogItem) error
 }
 
+// Source reads data to be archived. ForSet returns a new instance configured for the given
+// set, leaving the receiver unchanged so that sets can be processed concurrently.
 type Source interface {
-	ForSet(setName string, setJson json.RawMessage) error
+	ForSet(setName string, setJson json.RawMessage) (Source, error)
 	Read() ([]byte, error)
 }
+
+// StreamSource is a Source that can provide its data as a stream, avoiding the need to hold
+// the entire response in memory
+type StreamSource interface {
+	Source
+	ReadStream() (io.ReadCloser, error)
+}
+
+// StreamDestination is a Destination that can write data from a stream
+type StreamDestination interface {
+	Destination
+	WriteStream(data io.Reader, activityLog chan<- EventLogItem) error
+}
+
+// ChangeDetector is implemented by destinations that record a hash of the last data archived
+// for a set, so that unchanged data need not be archived again
+type ChangeDetector interface {
+	// LastContentHash returns the hash saved by SaveContentHash, or "" if there is none
+	LastContentHash() (string, error)
+	SaveContentHash(hash string) error
+}
+
+// ArchiveManifest records the last archive written for a set
+type ArchiveManifest struct {
+	ContentHash string
+	ObjectKey   string
+	Updated     time.Time
+}
+
+// Pruner is implemented by destinations that remove old archives according to a retention
+// policy. In dry-run mode, the archives that would be removed are only reported.
+type Pruner interface {
+	Prune(dryRun bool, eventLog chan<- EventLogItem) error
+}
+
+// EventLogger is implemented by adapters that report events outside of Write, such as sources.
+// RunSet provides the event log before reading from the source.
+type EventLogger interface {
+	SetEventLog(eventLog chan<- EventLogItem)
+}
+
+// SetState is the state of a set that is kept from one run to the next
+type SetState struct {
+	// LastRunTime is the start time of the last run that archived the set successfully
+	LastRunTime time.Time
+
+	// Watermark is the high-water mark reported by a WatermarkSource in the last successful run
+	Watermark string `json:",omitempty"`
+
+	// Size is the size in bytes of the data archived in the last successful run
+	Size int64 `json:",omitempty"`
+}
+
+// StateStore persists the SetState of each set
+type StateStore interface {
+	// Load returns the state of the set, or a zero SetState if none has been saved
+	Load(setName string) (SetState, error)
+	Save(setName string, state SetState) error
+}
+
+// StatefulSource is a Source that uses the time of the run and the state kept from the last run,
+// for example to request only the records modified since then. SetState is called before the
+// set is read.
+type StatefulSource interface {
+	Source
+	SetState(now time.Time, state SetState) error
+}
+
+// WatermarkSource is a Source that reports a high-water mark for the data it has read, such as
+// the latest modification time of the records. The watermark is saved in the set's state only
+// after the data is archived, so that it is provided to the source in the next run.
+type WatermarkSource interface {
+	Source
+	Watermark() string
+}
+
+// MetadataSource is a Source that describes the data it has read, such as the URL it was read
+// from or the number of records. The metadata is complete once the data has been read.
+type MetadataSource interface {
+	Source
+	SourceMetadata() map[string]string
+}
+
+// MetadataDestination is a Destination that records the metadata of a MetadataSource with the
+// data it writes. SetMetadataSource is called before the data is written.
+type MetadataDestination interface {
+	Destination
+	SetMetadataSource(source MetadataSource)
+}
+
+// FormatDestination is a Destination that names and labels the data it writes by its format.
+// SetDataFormat is called before the data is written with the Format of the set's Transform, such
+// as "ndjson" for one record per line.
+type FormatDestination interface {
+	Destination
+	SetDataFormat(format string)
+}
+
+// EncryptingDestination is a Destination that encrypts the data itself, after converting and
+// compressing it, rather than receiving encrypted data. SetEncryptionKey is called before the
+// data is written.
+type EncryptingDestination interface {
+	Destination
+	SetEncryptionKey(key []byte)
+}
@@ -0,0 +1,124 @@
+package restapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+const (
+	APIKeyInHeader = "header"
+	APIKeyInQuery  = "query"
+
+	DefaultAPIKeyHeader = "X-API-Key"
+	DefaultAPIKeyParam  = "api_key"
+)
+
+// APIKeyConfig configures the "apikey" auth type. The key itself is the adapter's Password.
+type APIKeyConfig struct {
+	// In is where the key is sent: "header" (default) or "query"
+	In string
+
+	// Name is the name of the header or query parameter. Default: "X-API-Key" for a header,
+	// "api_key" for a query parameter
+	Name string
+}
+
+func (c *APIKeyConfig) validate() error {
+	if c.In == "" {
+		c.In = APIKeyInHeader
+	}
+	switch c.In {
+	case APIKeyInHeader:
+		if c.Name == "" {
+			c.Name = DefaultAPIKeyHeader
+		}
+	case APIKeyInQuery:
+		if c.Name == "" {
+			c.Name = DefaultAPIKeyParam
+		}
+	default:
+		return fmt.Errorf("unrecognized APIKey In '%s'", c.In)
+	}
+	return nil
+}
+
+// addSecrets adds the API key to the values redacted from log output, if it is sent in the
+// query, where it appears escaped in the URLs of requests
+func (r *RestAPI) addSecrets() {
+	if r.APIKey.In != APIKeyInQuery {
+		return
+	}
+	internal.AddSecret(r.Password)
+	internal.AddSecret(url.QueryEscape(r.Password))
+}
+
+// setAPIKey adds the API key to the request. A key already in the query, such as in a next page
+// URL returned by the API, is left as is.
+func (r *RestAPI) setAPIKey(req *http.Request) {
+	if r.APIKey.In != APIKeyInQuery {
+		req.Header.Set(r.APIKey.Name, r.Password)
+		return
+	}
+
+	if _, ok := req.URL.Query()[r.APIKey.Name]; ok {
+		return
+	}
+	param := url.QueryEscape(r.APIKey.Name) + "=" + url.QueryEscape(r.Password)
+	if req.URL.RawQuery == "" {
+		req.URL.RawQuery = param
+	} else {
+		req.URL.RawQuery += "&" + param
+	}
+}
+
+// redactURL returns the URL as a string, with the password and any API key query parameter
+// replaced so that it can be logged
+func (r *RestAPI) redactURL(u *url.URL) string {
+	if r.AuthType != AuthTypeAPIKey || r.APIKey.In != APIKeyInQuery {
+		return u.Redacted()
+	}
+	query := u.Query()
+	if _, ok := query[r.APIKey.Name]; !ok {
+		return u.Redacted()
+	}
+	query.Set(r.APIKey.Name, "xxxxx")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.Redacted()
+}
+
+// redactRawURL is like redactURL for a URL given as a string
+func (r *RestAPI) redactRawURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return r.redactURL(u)
+}
+
+// redactError redacts the URL of a *url.Error, as returned by an http.Client, which otherwise
+// includes an API key sent in the query
+func (r *RestAPI) redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = r.redactRawURL(urlErr.URL)
+	}
+	return err
+}
+
+// headers returns the headers sent with every request of the set. Set headers take precedence
+// over adapter headers, which take precedence over the default Content-Type.
+func (r *RestAPI) headers() map[string]string {
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range r.Headers {
+		headers[k] = v
+	}
+	for k, v := range r.setConfig.Headers {
+		headers[k] = v
+	}
+	return headers
+}
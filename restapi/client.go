@@ -0,0 +1,211 @@
+package restapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultConnectTimeoutSeconds  = 30
+	DefaultResponseTimeoutSeconds = 60
+	DefaultBodyIdleTimeoutSeconds = 60
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HTTPClientConfig configures the http client used for all requests made by the adapter
+type HTTPClientConfig struct {
+	// ConnectTimeoutSeconds limits the time to establish a connection. Default: 30
+	ConnectTimeoutSeconds float64
+
+	// ResponseTimeoutSeconds limits the time to wait for the response headers after the request
+	// is sent. Default: 60
+	ResponseTimeoutSeconds float64
+
+	// BodyIdleTimeoutSeconds limits the time to wait for more of the response body. It applies to
+	// each read, so it stops a stalled response without limiting the time to read a large one.
+	// Default: 60
+	BodyIdleTimeoutSeconds float64
+
+	// TimeoutSeconds limits the total time of each request, including reading the response body.
+	// Default: no limit, so that large responses streamed to the destination are not cut off
+	TimeoutSeconds float64
+
+	// ProxyURL is the URL of a proxy server for all requests. If not set, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used.
+	ProxyURL string
+
+	// CABundleFile is the path to a PEM file of certificate authorities trusted in addition to
+	// the system roots
+	CABundleFile string
+
+	// ClientCertFile and ClientKeyFile are the paths to a PEM certificate and key presented to
+	// the server for mutual TLS
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// TLSMinVersion is the minimum TLS version: "1.0", "1.1", "1.2" (default) or "1.3"
+	TLSMinVersion string
+}
+
+func (c *HTTPClientConfig) setDefaults() {
+	if c.ConnectTimeoutSeconds <= 0 {
+		c.ConnectTimeoutSeconds = DefaultConnectTimeoutSeconds
+	}
+	if c.ResponseTimeoutSeconds <= 0 {
+		c.ResponseTimeoutSeconds = DefaultResponseTimeoutSeconds
+	}
+	if c.BodyIdleTimeoutSeconds <= 0 {
+		c.BodyIdleTimeoutSeconds = DefaultBodyIdleTimeoutSeconds
+	}
+	if c.TimeoutSeconds < 0 {
+		c.TimeoutSeconds = 0
+	}
+	if c.TLSMinVersion == "" {
+		c.TLSMinVersion = "1.2"
+	}
+}
+
+// newHTTPClient creates an http client from the config. It is created once per adapter so that
+// connections are reused across requests and sets.
+func newHTTPClient(config HTTPClientConfig) (*http.Client, error) {
+	config.setDefaults()
+
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized TLSMinVersion '%s'", config.TLSMinVersion)
+	}
+	tlsConfig := &tls.Config{MinVersion: minVersion}
+
+	if config.CABundleFile != "" {
+		pem, err := os.ReadFile(config.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CABundleFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ProxyURL: %s", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   seconds(config.ConnectTimeoutSeconds),
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   seconds(config.ConnectTimeoutSeconds),
+		ResponseHeaderTimeout: seconds(config.ResponseTimeoutSeconds),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Transport: &idleTimeoutTransport{
+			RoundTripper: transport,
+			timeout:      seconds(config.BodyIdleTimeoutSeconds),
+		},
+		Timeout: seconds(config.TimeoutSeconds),
+	}, nil
+}
+
+// idleTimeoutTransport cancels a request if no data is received from the response body within
+// the timeout of a read
+type idleTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &idleTimeoutBody{ReadCloser: resp.Body, timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		atomic.StoreInt32(&body.timedOut, 1)
+		cancel()
+	})
+	body.timer.Stop()
+	resp.Body = body
+	return resp, nil
+}
+
+// idleTimeoutBody is a response body that cancels its request if a read takes longer than the
+// timeout. Time between reads is not counted, so a slow destination does not cause a timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut int32
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		err = fmt.Errorf("no data received from the response body for %s: %w", b.timeout, err)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// httpClient returns the adapter's http client, or a default client if the adapter was not
+// created by NewRestAPISource
+func (r *RestAPI) httpClient() *http.Client {
+	if r.client == nil {
+		return &http.Client{}
+	}
+	return r.client
+}
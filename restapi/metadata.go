@@ -0,0 +1,301 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// The keys of the metadata reported by SourceMetadata
+const (
+	MetadataSourceURL   = "SourceURL"
+	MetadataHTTPStatus  = "HTTPStatus"
+	MetadataRecordCount = "RecordCount"
+)
+
+// sourceMetadata describes the data read for a set. It is updated by the requests, which may be
+// made in another goroutine while the data is streamed.
+type sourceMetadata struct {
+	mutex   sync.Mutex
+	url     string
+	status  int
+	records int
+	counted bool
+}
+
+// request records the URL of the first request and the status of the latest response
+func (m *sourceMetadata) request(url string, status int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.url == "" {
+		m.url = url
+	}
+	m.status = status
+}
+
+// addRecords adds to the number of records read
+func (m *sourceMetadata) addRecords(n int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.records += n
+	m.counted = true
+}
+
+// hasRecordCount returns true if the number of records has been counted
+func (m *sourceMetadata) hasRecordCount() bool {
+	if m == nil {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counted
+}
+
+// SourceMetadata returns the redacted URL of the set's first request, the HTTP status of the last
+// response, and the number of records read. The records are those at the RecordsPath of the set,
+// or of its Pagination, Watermark or Validation, or the response itself if it is an array. If the
+// records can't be found, the number is empty.
+func (r *RestAPI) SourceMetadata() map[string]string {
+	metadata := map[string]string{
+		MetadataSourceURL:   "",
+		MetadataHTTPStatus:  "",
+		MetadataRecordCount: "",
+	}
+	m := r.metadata
+	if m == nil {
+		return metadata
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	metadata[MetadataSourceURL] = m.url
+	if m.status != 0 {
+		metadata[MetadataHTTPStatus] = strconv.Itoa(m.status)
+	}
+	if m.counted {
+		metadata[MetadataRecordCount] = strconv.Itoa(m.records)
+	}
+	return metadata
+}
+
+// recordRequest records the request in the set's metadata, with the URL redacted
+func (r *RestAPI) recordRequest(rawURL string, status int) {
+	if r.metadata == nil {
+		return
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	r.metadata.request(r.redactURL(u), status)
+}
+
+// recordsPath returns the path of the records in the response, for the RecordCount metadata
+func (s *SetConfig) recordsPath() string {
+	if s.RecordsPath == "" && s.Validation != nil {
+		return s.Validation.RecordsPath
+	}
+	return s.RecordsPath
+}
+
+// countRecords counts the records in the complete response, if they have not been counted as the
+// response was read
+func (r *RestAPI) countRecords(data []byte) {
+	if r.metadata.hasRecordCount() {
+		return
+	}
+	p := Pagination{RecordsPath: r.setConfig.recordsPath()}
+	if records, _, err := p.pageRecords(data); err == nil {
+		r.metadata.addRecords(len(records))
+	}
+}
+
+// recordCountingBody counts the records of a streamed response, and records the number in the
+// set's metadata once the response has been read
+type recordCountingBody struct {
+	io.ReadCloser
+	r       *RestAPI
+	counter recordCounter
+	done    bool
+}
+
+func (b *recordCountingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.scan(p[:n])
+	if err == io.EOF && !b.done {
+		b.done = true
+		if count, ok := b.counter.count(); ok {
+			b.r.metadata.addRecords(count)
+		}
+	}
+	return n, err
+}
+
+// recordCounter counts the elements of the JSON array at a path, as the JSON is scanned, without
+// decoding it. A null value at the path counts as no records.
+type recordCounter struct {
+	path []string
+
+	// stack holds the arrays and objects that contain the current position
+	stack []jsonContainer
+
+	inString   bool
+	escaped    bool
+	inScalar   bool
+	readingKey bool
+	key        []byte
+
+	// counting is the depth of the array of records once it is found
+	counting int
+	elements int
+	found    bool
+	failed   bool
+}
+
+// jsonContainer is an array or object being scanned by a recordCounter
+type jsonContainer struct {
+	array     bool
+	index     int
+	key       string
+	expectKey bool
+}
+
+func newRecordCounter(path string) recordCounter {
+	return recordCounter{path: internal.SplitJSONPath(path)}
+}
+
+func (c *recordCounter) scan(data []byte) {
+	for _, b := range data {
+		if c.found || c.failed {
+			return
+		}
+		if c.inString {
+			switch {
+			case c.escaped:
+				c.escaped = false
+			case b == '\\':
+				c.escaped = true
+			case b == '"':
+				c.inString = false
+				if c.readingKey {
+					c.readingKey = false
+					c.top().key = decodeKey(c.key)
+					c.key = c.key[:0]
+				}
+				continue
+			}
+			if c.readingKey {
+				c.key = append(c.key, b)
+			}
+			continue
+		}
+
+		switch b {
+		case ' ', '\t', '\r', '\n', ':':
+			c.inScalar = false
+		case '[', '{':
+			c.inScalar = false
+			c.startValue(b)
+			c.stack = append(c.stack, jsonContainer{array: b == '[', expectKey: b == '{'})
+			if b == '[' && c.atPath(len(c.stack)-1) {
+				c.counting = len(c.stack)
+			}
+		case ']', '}':
+			c.inScalar = false
+			if len(c.stack) == 0 {
+				c.failed = true
+				return
+			}
+			if c.counting == len(c.stack) {
+				c.found = true
+				return
+			}
+			c.stack = c.stack[:len(c.stack)-1]
+		case ',':
+			c.inScalar = false
+			if top := c.top(); top != nil {
+				top.index++
+				top.expectKey = !top.array
+			}
+		case '"':
+			if top := c.top(); top != nil && top.expectKey {
+				top.expectKey = false
+				c.readingKey = true
+			} else {
+				c.startValue(b)
+			}
+			c.inString = true
+		default:
+			if !c.inScalar {
+				c.inScalar = true
+				c.startValue(b)
+			}
+		}
+	}
+}
+
+// startValue is called at the first byte of each value
+func (c *recordCounter) startValue(b byte) {
+	if c.counting > 0 && c.counting == len(c.stack) {
+		c.elements++
+		return
+	}
+	if c.counting == 0 && c.atPath(len(c.stack)) && b != '[' {
+		// a null value has no records, and any other value is not an array of records
+		c.found = b == 'n'
+		c.failed = !c.found
+	}
+}
+
+// atPath returns true if the position within the first depth containers is the path
+func (c *recordCounter) atPath(depth int) bool {
+	if depth != len(c.path) {
+		return false
+	}
+	for i, key := range c.path {
+		container := c.stack[i]
+		if container.array {
+			if strconv.Itoa(container.index) != key {
+				return false
+			}
+		} else if container.key != key {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *recordCounter) top() *jsonContainer {
+	if len(c.stack) == 0 {
+		return nil
+	}
+	return &c.stack[len(c.stack)-1]
+}
+
+// count returns the number of records, or false if they were not found
+func (c *recordCounter) count() (int, bool) {
+	return c.elements, c.found
+}
+
+// decodeKey returns the object key from the bytes between its quotes
+func decodeKey(raw []byte) string {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return string(raw)
+	}
+	var key string
+	if err := json.Unmarshal(append(append([]byte{'"'}, raw...), '"'), &key); err != nil {
+		return string(raw)
+	}
+	return key
+}
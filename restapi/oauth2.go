@@ -0,0 +1,236 @@
+package restapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypePassword          = "password"
+
+	ClientAuthHeader = "header"
+	ClientAuthBody   = "body"
+
+	// tokenExpiryMargin is how long before its expiry a token is refreshed
+	tokenExpiryMargin = time.Minute
+)
+
+// OAuth2Config configures the "oauth2" auth type. The client ID and secret are taken from the
+// adapter's ClientID and ClientSecret, and for the password grant the resource owner's
+// credentials are its Username and Password.
+type OAuth2Config struct {
+	// TokenURL is the token endpoint of the authorization server
+	TokenURL string
+
+	// GrantType is "client_credentials" (default), "refresh_token" or "password"
+	GrantType string
+
+	// Scopes are requested for the token, if any
+	Scopes []string
+
+	// Audience is sent as the "audience" parameter if set, as required by some servers
+	Audience string
+
+	// RefreshToken is the long-lived token used with the refresh_token grant
+	RefreshToken string
+
+	// ClientAuth is how the client ID and secret are sent: "header" (HTTP basic, default) or
+	// "body" (form parameters)
+	ClientAuth string
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	InstanceURL  string `json:"instance_url"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+// oauth2TokenSource obtains access tokens and caches them until they expire. It is shared by all
+// of the per-set copies of the adapter.
+type oauth2TokenSource struct {
+	config       OAuth2Config
+	clientID     string
+	clientSecret string
+	username     string
+	password     string
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+func (c *OAuth2Config) validate() error {
+	if c.TokenURL == "" {
+		return errors.New("oauth2 auth requires a TokenURL")
+	}
+	if c.GrantType == "" {
+		c.GrantType = GrantTypeClientCredentials
+	}
+	switch c.GrantType {
+	case GrantTypeClientCredentials, GrantTypePassword:
+	case GrantTypeRefreshToken:
+		if c.RefreshToken == "" {
+			return errors.New("the refresh_token grant requires a RefreshToken")
+		}
+	default:
+		return fmt.Errorf("unrecognized GrantType '%s'", c.GrantType)
+	}
+	if c.ClientAuth == "" {
+		c.ClientAuth = ClientAuthHeader
+	}
+	if c.ClientAuth != ClientAuthHeader && c.ClientAuth != ClientAuthBody {
+		return fmt.Errorf("unrecognized ClientAuth '%s'", c.ClientAuth)
+	}
+	return nil
+}
+
+// configureOAuth2 creates the token source for the oauth2 and SalesforceOauth auth types and
+// gets the first token, so that configuration errors are reported before any set is run
+func (r *RestAPI) configureOAuth2() error {
+	config := r.OAuth2
+	if r.AuthType == AuthTypeSalesforceOauth {
+		// Salesforce uses the password grant, with the token URL given as the BaseURL
+		config = OAuth2Config{
+			TokenURL:   r.BaseURL,
+			GrantType:  GrantTypePassword,
+			ClientAuth: ClientAuthBody,
+		}
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	r.oauth = &oauth2TokenSource{
+		config:       config,
+		clientID:     r.ClientID,
+		clientSecret: r.ClientSecret,
+		username:     r.Username,
+		password:     r.Password,
+	}
+
+	resp, err := r.oauth.refresh(r)
+	if err != nil {
+		return err
+	}
+
+	// Salesforce API requests must be made to the instance URL returned with the token
+	if r.AuthType == AuthTypeSalesforceOauth {
+		r.BaseURL = strings.TrimSuffix(resp.InstanceURL, "/")
+		log.Printf("Using Salesforce instance URL %s as the BaseURL", r.BaseURL)
+	}
+	return nil
+}
+
+// token returns a valid access token, requesting a new one if the cached token has expired
+func (s *oauth2TokenSource) token(r *RestAPI) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accessToken != "" && (s.expiry.IsZero() || time.Now().Add(tokenExpiryMargin).Before(s.expiry)) {
+		return s.accessToken, nil
+	}
+
+	resp, err := s.requestToken(r)
+	if err != nil {
+		return "", err
+	}
+	return resp.AccessToken, nil
+}
+
+// invalidate discards the cached token if it is the given token, so that the next request gets a
+// new one. A token that was already replaced by another request is left alone.
+func (s *oauth2TokenSource) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken == token {
+		s.accessToken = ""
+	}
+}
+
+// refresh requests a new access token from the token endpoint
+func (s *oauth2TokenSource) refresh(r *RestAPI) (oauth2TokenResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestToken(r)
+}
+
+// requestToken requests a new access token and caches it. The caller must hold the lock.
+func (s *oauth2TokenSource) requestToken(r *RestAPI) (oauth2TokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", s.config.GrantType)
+	switch s.config.GrantType {
+	case GrantTypePassword:
+		form.Set("username", s.username)
+		form.Set("password", s.password)
+	case GrantTypeRefreshToken:
+		form.Set("refresh_token", s.config.RefreshToken)
+	}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	if s.config.Audience != "" {
+		form.Set("audience", s.config.Audience)
+	}
+	if s.config.ClientAuth == ClientAuthBody {
+		form.Set("client_id", s.clientID)
+		form.Set("client_secret", s.clientSecret)
+	}
+
+	resp, err := r.doWithRetry(r.httpClient(), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("User-Agent", r.UserAgent)
+		if s.config.ClientAuth == ClientAuthHeader {
+			req.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return oauth2TokenResponse{}, fmt.Errorf("error requesting OAuth token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return oauth2TokenResponse{}, fmt.Errorf("error reading OAuth token response: %s", err)
+	}
+
+	var tokenResponse oauth2TokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return oauth2TokenResponse{}, fmt.Errorf("unable to parse OAuth token response, status: %s, error: %s",
+			resp.Status, err)
+	}
+	if resp.StatusCode >= 400 || tokenResponse.AccessToken == "" {
+		return oauth2TokenResponse{}, fmt.Errorf("OAuth token request failed, status: %s, error: %s %s",
+			resp.Status, tokenResponse.Error, tokenResponse.ErrorDesc)
+	}
+
+	s.accessToken = tokenResponse.AccessToken
+	s.expiry = time.Time{}
+	if tokenResponse.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+	if tokenResponse.RefreshToken != "" && s.config.GrantType == GrantTypeRefreshToken {
+		s.config.RefreshToken = tokenResponse.RefreshToken
+	}
+
+	return tokenResponse, nil
+}
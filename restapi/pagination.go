@@ -0,0 +1,286 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+const (
+	PaginationNextURL    = "NextURL"
+	PaginationLinkHeader = "LinkHeader"
+	PaginationOffset     = "Offset"
+	PaginationCursor     = "Cursor"
+	DefaultOffsetParam   = "offset"
+	DefaultLimitParam    = "limit"
+)
+
+// Pagination configures how the pages of a paginated endpoint are requested. The records from
+// every page are merged into a single JSON array.
+type Pagination struct {
+	// Type is one of "NextURL", "LinkHeader", "Offset", or "Cursor"
+	Type string
+
+	// RecordsPath is the JSON path to the array of records in each page. If empty, the page
+	// itself must be an array.
+	RecordsPath string
+
+	// NextURLPath is the JSON path to the URL of the next page (NextURL type only), for example
+	// "nextRecordsUrl" for Salesforce. Relative URLs are resolved against the current page URL.
+	NextURLPath string
+
+	// CursorPath is the JSON path to the cursor for the next page (Cursor type only)
+	CursorPath string
+
+	// CursorParam is the query parameter, or GraphQL variable, used to send the cursor (Cursor
+	// type only)
+	CursorParam string
+
+	// OffsetParam is the query parameter, or GraphQL variable, used to send the record offset
+	// (Offset type only). Default: "offset"
+	OffsetParam string
+
+	// LimitParam is the query parameter, or GraphQL variable, used to send the page size, taken
+	// from the adapter's BatchSize. Default for the Offset type: "limit". Other types only send a
+	// page size if set.
+	LimitParam string
+
+	// MaxPages stops pagination after the given number of pages. Zero means no limit.
+	MaxPages int
+}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]*)>\s*;[^,]*rel="?next"?`)
+
+func (p *Pagination) validate() error {
+	switch p.Type {
+	case "":
+		return nil
+	case PaginationNextURL:
+		if p.NextURLPath == "" {
+			return errors.New("pagination type NextURL requires a NextURLPath")
+		}
+	case PaginationCursor:
+		if p.CursorPath == "" || p.CursorParam == "" {
+			return errors.New("pagination type Cursor requires a CursorPath and a CursorParam")
+		}
+	case PaginationOffset:
+		if p.OffsetParam == "" {
+			p.OffsetParam = DefaultOffsetParam
+		}
+		if p.LimitParam == "" {
+			p.LimitParam = DefaultLimitParam
+		}
+	case PaginationLinkHeader:
+	default:
+		return fmt.Errorf("unrecognized pagination type '%s'", p.Type)
+	}
+	return nil
+}
+
+// writePages requests each page in turn, waiting BatchDelaySeconds between pages, and writes
+// the records of all pages to w as one JSON array. A page that was already requested is an error,
+// so that an API that returns the same next page again doesn't cause an endless loop.
+func (r *RestAPI) writePages(w io.Writer, firstURL string, headers map[string]string) error {
+	p := r.setConfig.Pagination
+	graphQL := r.setConfig.GraphQL != nil
+	page := pageRequest{url: firstURL}
+	if p.LimitParam != "" {
+		page = page.withParam(graphQL, p.LimitParam, r.BatchSize)
+	}
+	if p.Type == PaginationOffset {
+		page = page.withParam(graphQL, p.OffsetParam, 0)
+	}
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	total := 0
+	requested := map[string]bool{}
+	for pageNumber := 1; ; pageNumber++ {
+		key := page.key()
+		if requested[key] {
+			return fmt.Errorf("page %d from %s was already requested, pagination stopped",
+				pageNumber, r.redactRawURL(page.url))
+		}
+		requested[key] = true
+
+		requestBody, err := r.body(page.variables)
+		if err != nil {
+			return err
+		}
+
+		body, header, err := r.request(r.method(), page.url, requestBody, headers)
+		if err != nil {
+			return fmt.Errorf("restAPI Read failed with http error: %s, %s, url: %s", err, body, r.redactRawURL(page.url))
+		}
+
+		if err := r.setConfig.Validation.checkContentType(header); err != nil {
+			return r.validationFailed(page.url, err)
+		}
+
+		pageRecords, doc, err := p.pageRecords(body)
+		if err == nil && graphQL {
+			err = graphQLErrors(doc)
+		}
+		if err == nil {
+			err = r.observeWatermark(pageRecords)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading page %d from %s: %s", pageNumber, r.redactRawURL(page.url), err)
+		}
+		r.metadata.addRecords(len(pageRecords))
+		for _, record := range pageRecords {
+			if total > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(record); err != nil {
+				return err
+			}
+			total++
+		}
+
+		if p.MaxPages > 0 && pageNumber >= p.MaxPages {
+			break
+		}
+
+		next, ok, err := p.nextPage(page, graphQL, doc, header, total, len(pageRecords))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		page = next
+
+		time.Sleep(time.Duration(r.BatchDelaySeconds) * time.Second)
+	}
+
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// pageRecords returns the records contained in a page, exactly as they appear in the page, as
+// well as the decoded page document
+func (p *Pagination) pageRecords(body []byte) ([]json.RawMessage, interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("page is not valid JSON: %s", err)
+	}
+
+	var records []json.RawMessage
+	if p.RecordsPath == "" {
+		if err := json.Unmarshal(body, &records); err != nil {
+			return nil, nil, errors.New("page is not a JSON array and no RecordsPath is configured")
+		}
+		return records, doc, nil
+	}
+
+	value, ok := internal.GetRawJSONPath(body, p.RecordsPath)
+	if !ok {
+		return nil, nil, fmt.Errorf("no records found at '%s'", p.RecordsPath)
+	}
+	if string(bytes.TrimSpace(value)) == "null" {
+		return nil, doc, nil
+	}
+	if err := json.Unmarshal(value, &records); err != nil {
+		return nil, nil, fmt.Errorf("value at '%s' is not an array", p.RecordsPath)
+	}
+	return records, doc, nil
+}
+
+// nextPage returns the request for the page following the current page, or false if there are
+// no more pages
+func (p *Pagination) nextPage(page pageRequest, graphQL bool, doc interface{}, header http.Header, total, count int) (pageRequest, bool, error) {
+	switch p.Type {
+	case PaginationNextURL:
+		next := internal.GetJSONPathString(doc, p.NextURLPath)
+		if next == "" {
+			return pageRequest{}, false, nil
+		}
+		nextURL, err := resolveURL(page.url, next)
+		return pageRequest{url: nextURL, variables: page.variables}, err == nil, err
+
+	case PaginationLinkHeader:
+		for _, link := range header.Values("Link") {
+			if m := linkNextRegexp.FindStringSubmatch(link); m != nil {
+				nextURL, err := resolveURL(page.url, m[1])
+				return pageRequest{url: nextURL, variables: page.variables}, err == nil, err
+			}
+		}
+		return pageRequest{}, false, nil
+
+	case PaginationOffset:
+		// A page may have fewer records than requested if the API limits the page size, so only
+		// an empty page is the end
+		if count == 0 {
+			return pageRequest{}, false, nil
+		}
+		return page.withParam(graphQL, p.OffsetParam, total), true, nil
+
+	case PaginationCursor:
+		cursor := internal.GetJSONPathString(doc, p.CursorPath)
+		if cursor == "" {
+			return pageRequest{}, false, nil
+		}
+		return page.withParam(graphQL, p.CursorParam, cursor), true, nil
+	}
+
+	return pageRequest{}, false, nil
+}
+
+// key identifies the page request, to detect a page that is requested again
+func (p pageRequest) key() string {
+	variables, _ := json.Marshal(p.variables)
+	return p.url + " " + string(variables)
+}
+
+// withParam returns a copy of the page request with the given GraphQL variable, or query
+// parameter if not a GraphQL request
+func (p pageRequest) withParam(graphQL bool, name string, value interface{}) pageRequest {
+	if !graphQL {
+		return pageRequest{url: setQueryParam(p.url, name, fmt.Sprint(value)), variables: p.variables}
+	}
+
+	variables := make(map[string]interface{}, len(p.variables)+1)
+	for k, v := range p.variables {
+		variables[k] = v
+	}
+	variables[name] = value
+	return pageRequest{url: p.url, variables: variables}
+}
+
+func resolveURL(base, ref string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid page URL '%s': %s", base, err)
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page URL '%s': %s", ref, err)
+	}
+	return baseURL.ResolveReference(refURL).String(), nil
+}
+
+func setQueryParam(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,139 @@
+package restapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// GraphQLConfig configures a set that is read with a GraphQL query. The query is sent with a POST
+// request, regardless of the adapter's RequestMethod.
+type GraphQLConfig struct {
+	// Query is the GraphQL query document
+	Query string
+
+	// Variables are sent with the query. With Cursor or Offset pagination, the cursor, offset and
+	// page size are added as the variables named by the CursorParam, OffsetParam and LimitParam.
+	Variables map[string]interface{}
+}
+
+// pageRequest holds what differs between the requests for the pages of a set
+type pageRequest struct {
+	url       string
+	variables map[string]interface{}
+}
+
+func (s *SetConfig) validate() error {
+	if s.GraphQL != nil {
+		if s.GraphQL.Query == "" {
+			return errors.New("GraphQL requires a Query")
+		}
+		if len(s.Body) > 0 {
+			return errors.New("Body cannot be used with GraphQL")
+		}
+		switch s.Pagination.Type {
+		case "", PaginationCursor, PaginationOffset:
+		default:
+			return fmt.Errorf("pagination type '%s' cannot be used with GraphQL", s.Pagination.Type)
+		}
+	}
+	if len(s.Body) > 0 && !json.Valid(s.Body) {
+		return errors.New("Body is not valid JSON")
+	}
+	return nil
+}
+
+// url returns the URL of the set, including its Query parameters
+func (r *RestAPI) url() string {
+	u := r.BaseURL + r.setConfig.Path
+	if len(r.setConfig.Query) == 0 {
+		return u
+	}
+
+	keys := make([]string, 0, len(r.setConfig.Query))
+	for k := range r.setConfig.Query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = url.QueryEscape(k) + "=" + url.QueryEscape(r.setConfig.Query[k])
+	}
+	if strings.Contains(u, "?") {
+		return u + "&" + strings.Join(params, "&")
+	}
+	return u + "?" + strings.Join(params, "&")
+}
+
+// method returns the request method of the set
+func (r *RestAPI) method() string {
+	if r.setConfig.GraphQL != nil {
+		return http.MethodPost
+	}
+	return r.RequestMethod
+}
+
+// body returns the request body of the set. A Body given as a JSON string is sent as is, and
+// any other JSON value is sent as JSON. For GraphQL, the page variables are merged with the
+// configured Variables.
+func (r *RestAPI) body(pageVariables map[string]interface{}) (string, error) {
+	if q := r.setConfig.GraphQL; q != nil {
+		variables := map[string]interface{}{}
+		for k, v := range q.Variables {
+			variables[k] = v
+		}
+		for k, v := range pageVariables {
+			variables[k] = v
+		}
+		body, err := json.Marshal(map[string]interface{}{"query": q.Query, "variables": variables})
+		if err != nil {
+			return "", fmt.Errorf("unable to encode GraphQL request: %s", err)
+		}
+		return string(body), nil
+	}
+
+	if len(r.setConfig.Body) == 0 {
+		return "", nil
+	}
+	var raw string
+	if err := json.Unmarshal(r.setConfig.Body, &raw); err == nil {
+		return raw, nil
+	}
+	return string(r.setConfig.Body), nil
+}
+
+// graphQLErrors returns an error if a GraphQL response contains errors
+func graphQLErrors(doc interface{}) error {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	list, ok := m["errors"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(list))
+	for i, e := range list {
+		if item, ok := e.(map[string]interface{}); ok && item["message"] != nil {
+			messages[i] = fmt.Sprint(item["message"])
+		} else {
+			messages[i] = fmt.Sprint(e)
+		}
+	}
+	return fmt.Errorf("GraphQL errors: %s", strings.Join(messages, "; "))
+}
+
+// checkGraphQLResponse returns an error if the response body is not JSON or contains errors
+func checkGraphQLResponse(body []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("GraphQL response is not valid JSON: %s", err)
+	}
+	return graphQLErrors(doc)
+}
@@ -1,15 +1,17 @@
 package restapi
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/syslog"
 	"net/http"
-	"net/url"
-	"strconv"
 	"strings"
+	"time"
 
 	internal "github.com/silinternational/rest-data-archiver/internal"
 )
@@ -17,6 +19,8 @@ import (
 const (
 	AuthTypeBasic            = "basic"
 	AuthTypeBearer           = "bearer"
+	AuthTypeOAuth2           = "oauth2"
+	AuthTypeAPIKey           = "apikey"
 	AuthTypeSalesforceOauth  = "SalesforceOauth"
 	DefaultBatchSize         = 10
 	DefaultBatchDelaySeconds = 3
@@ -33,122 +37,276 @@ type RestAPI struct {
 	UserAgent         string
 	BatchSize         int
 	BatchDelaySeconds int
+	Headers           map[string]string
+	APIKey            APIKeyConfig
+	OAuth2            OAuth2Config
+	Retry             RetryPolicy
+	HTTPClient        HTTPClientConfig
+	client            *http.Client
+	oauth             *oauth2TokenSource
 	destinationConfig internal.DestinationConfig
+	hasStateStore     bool
+	dryRunMode        bool
+	setName           string
 	setConfig         SetConfig
+	rendered          bool
+	watermark         *watermarkTracker
+	lastSize          int64
+	metadata          *sourceMetadata
+	eventLog          chan<- internal.EventLogItem
 }
 
 type SetConfig struct {
-	Path string
+	Path       string
+	Query      map[string]string
+	Body       json.RawMessage
+	GraphQL    *GraphQLConfig
+	Headers    map[string]string
+	Pagination Pagination
+	Watermark  *WatermarkConfig
+	Validation *ValidationConfig
+
+	// RecordsPath is the path to the array of records in the response, which are counted for the
+	// RecordCount metadata as the response is streamed. If omitted, the RecordsPath of the
+	// Validation is used, or the response itself if it is an array.
+	RecordsPath string
+}
+
+func init() {
+	internal.RegisterSource(internal.SourceTypeRestAPI, NewRestAPISource)
 }
 
 // NewRestAPISource unmarshals the sourceConfig's ExtraJson into a RestApi struct
 func NewRestAPISource(sourceConfig internal.SourceConfig) (internal.Source, error) {
 	var restAPI RestAPI
 	// Unmarshal ExtraJSON into RestAPI struct
-	err := json.Unmarshal(sourceConfig.AdapterConfig, &restAPI)
+	err := internal.UnmarshalConfig(sourceConfig.AdapterConfig, &restAPI)
 	if err != nil {
-		return &RestAPI{}, fmt.Errorf("json.Unmarshal error in adapter config:\n%s\nerror: %s",
-			sourceConfig.AdapterConfig, err.Error())
+		return &RestAPI{}, fmt.Errorf("json.Unmarshal error in adapter config: %s", err.Error())
 	}
 
+	restAPI.hasStateStore = sourceConfig.HasStateStore
+	restAPI.dryRunMode = sourceConfig.DryRunMode
+
+	// A BatchDelaySeconds of 0 means no delay, so the default only applies if it isn't configured
+	if !hasKey(sourceConfig.AdapterConfig, "BatchDelaySeconds") {
+		restAPI.BatchDelaySeconds = DefaultBatchDelaySeconds
+	}
 	restAPI.setDefaults()
 
-	if restAPI.AuthType == AuthTypeSalesforceOauth {
-		token, err := restAPI.getSalesforceOauthToken()
-		if err != nil {
+	restAPI.client, err = newHTTPClient(restAPI.HTTPClient)
+	if err != nil {
+		return &RestAPI{}, fmt.Errorf("error in HTTPClient config: %s", err)
+	}
+
+	if restAPI.AuthType == AuthTypeAPIKey {
+		if err := restAPI.APIKey.validate(); err != nil {
+			return &RestAPI{}, fmt.Errorf("error in APIKey config: %s", err)
+		}
+		restAPI.addSecrets()
+	}
+
+	if restAPI.AuthType == AuthTypeOAuth2 || restAPI.AuthType == AuthTypeSalesforceOauth {
+		if err := restAPI.configureOAuth2(); err != nil {
 			log.Println(err)
 			return &RestAPI{}, errors.New("error getting Oauth token: " + err.Error())
 		}
-
-		restAPI.Password = token
 	}
 
 	return &restAPI, nil
 }
 
-// ForSet sets this RestAPI structs Path value to the one in the unmarshalled setJson.
+// ForSet returns a copy of this RestAPI struct with the Path value from the unmarshalled setJson.
 // It ensures the resulting Path attribute includes an initial "/"
-func (r *RestAPI) ForSet(setName string, syncSetJson json.RawMessage) error {
+func (r *RestAPI) ForSet(setName string, syncSetJson json.RawMessage) (internal.Source, error) {
 	var setConfig SetConfig
-	err := json.Unmarshal(syncSetJson, &setConfig)
+	err := internal.UnmarshalConfig(syncSetJson, &setConfig)
 	if err != nil {
-		return fmt.Errorf("bad configuration in set '%s': %s", setName, err)
+		return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
 	}
 
 	if len(setConfig.Path) == 0 {
-		return errors.New("'path' is empty in sync set " + setName)
+		return nil, errors.New("'path' is empty in sync set " + setName)
 	}
 
 	if !strings.HasPrefix(setConfig.Path, "/") {
 		setConfig.Path = "/" + setConfig.Path
 	}
 
-	r.setConfig = setConfig
+	if err := setConfig.Pagination.validate(); err != nil {
+		return nil, fmt.Errorf("bad pagination configuration in set '%s': %s", setName, err)
+	}
 
-	return nil
+	if err := setConfig.validate(); err != nil {
+		return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
+	}
+
+	if setConfig.Validation != nil {
+		if err := setConfig.Validation.init(); err != nil {
+			return nil, fmt.Errorf("bad validation configuration in set '%s': %s", setName, err)
+		}
+		// The size of the last run is kept in the state store
+		if setConfig.Validation.MaxShrinkPercent > 0 && !r.hasStateStore {
+			return nil, fmt.Errorf("bad validation configuration in set '%s': MaxShrinkPercent requires a State store", setName)
+		}
+	}
+
+	// Check the templates now, rather than when the set is read
+	if _, err := setConfig.render(internal.TemplateData{Now: time.Now(), SetName: setName}); err != nil {
+		return nil, fmt.Errorf("bad configuration in set '%s': %s", setName, err)
+	}
+
+	setAPI := *r
+	setAPI.setName = setName
+	setAPI.setConfig = setConfig
+	setAPI.rendered = false
+	setAPI.watermark = nil
+	setAPI.lastSize = 0
+	setAPI.metadata = &sourceMetadata{}
+
+	return &setAPI, nil
 }
 
 func (r *RestAPI) Read() ([]byte, error) {
-	headers := map[string]string{"Content-Type": "application/json"}
-	url := r.BaseURL + r.setConfig.Path
-	request, err := r.httpRequest(r.RequestMethod, url, "", headers)
+	if err := r.renderSet(internal.TemplateData{}); err != nil {
+		return nil, err
+	}
+
+	data, err := r.read()
 	if err != nil {
-		return nil, fmt.Errorf("restAPI Read failed with http error: %s, %s, url: %s", err, request, url)
+		return nil, err
 	}
-	return request, nil
-}
 
-type SalesforceAuthResponse struct {
-	ID          string `json:"id"`
-	IssuedAt    string `json:"issued_at"`
-	InstanceURL string `json:"instance_url"`
-	Signature   string `json:"signature"`
-	AccessToken string `json:"access_token"`
+	if v := r.setConfig.Validation; v != nil {
+		if err := v.validate(data, r.lastSize); err != nil {
+			return nil, r.validationFailed(r.url(), err)
+		}
+	}
+	r.countRecords(data)
+	return data, nil
 }
 
-func (r *RestAPI) getSalesforceOauthToken() (string, error) {
-	// Body params
-	data := url.Values{}
-	data.Set("grant_type", "password")
-	data.Set("username", r.Username)
-	data.Set("password", r.Password)
-	data.Set("client_id", r.ClientID)
-	data.Set("client_secret", r.ClientSecret)
+// read requests the set's data, checking the response as it is read
+func (r *RestAPI) read() ([]byte, error) {
+	headers := r.headers()
+	url := r.url()
+	if r.setConfig.Pagination.Type != "" {
+		var buf bytes.Buffer
+		if err := r.writePages(&buf, url, headers); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, r.BaseURL, strings.NewReader(data.Encode()))
+	body, err := r.body(nil)
 	if err != nil {
-		log.Println(err)
-		return "", err
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Length", strconv.Itoa(len(data.Encode())))
-
-	resp, err := client.Do(req)
+	request, header, err := r.request(r.method(), url, body, headers)
 	if err != nil {
-		log.Println(err)
-		return "", err
+		return nil, fmt.Errorf("restAPI Read failed with http error: %s, %s, url: %s", err, request, r.redactRawURL(url))
+	}
+
+	if err := r.setConfig.Validation.checkContentType(header); err != nil {
+		return nil, r.validationFailed(url, err)
+	}
+
+	if r.setConfig.GraphQL != nil {
+		if err := checkGraphQLResponse(request); err != nil {
+			return nil, fmt.Errorf("restAPI Read failed: %s, url: %s", err, r.redactRawURL(url))
+		}
+	}
+
+	if r.setConfig.Watermark != nil && r.setConfig.Watermark.Path != "" {
+		p := Pagination{RecordsPath: r.setConfig.Watermark.RecordsPath}
+		records, _, err := p.pageRecords(request)
+		if err == nil {
+			r.metadata.addRecords(len(records))
+			err = r.observeWatermark(records)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading watermark from %s: %s", r.redactRawURL(url), err)
+		}
+	}
+	return request, nil
+}
+
+// ReadStream returns the response body without reading it into memory. Paginated sets are
+// streamed one page at a time.
+func (r *RestAPI) ReadStream() (io.ReadCloser, error) {
+	if err := r.renderSet(internal.TemplateData{}); err != nil {
+		return nil, err
+	}
+
+	headers := r.headers()
+	url := r.url()
+	if r.setConfig.Pagination.Type != "" && r.setConfig.Validation == nil {
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pw.CloseWithError(r.writePages(pw, url, headers))
+		}()
+		return &pageReader{PipeReader: pr, done: done}, nil
+	}
+
+	if r.setConfig.GraphQL != nil || r.setConfig.Validation != nil ||
+		(r.setConfig.Watermark != nil && r.setConfig.Watermark.Path != "") {
+		// GraphQL errors are reported in the response body, and the response is validated and a
+		// watermark is read from it, so it must be read in full before it is archived
+		data, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
 	}
 
-	bodyText, err := ioutil.ReadAll(resp.Body)
+	body, err := r.body(nil)
 	if err != nil {
-		log.Printf("error reading response body: %s", err.Error())
-		return "", err
+		return nil, err
 	}
 
-	var authResponse SalesforceAuthResponse
-	err = json.Unmarshal(bodyText, &authResponse)
+	resp, err := r.send(r.method(), url, body, headers)
 	if err != nil {
-		log.Printf("Unable to parse auth response, status: %v, err: %s. body: %s", resp.StatusCode, err.Error(), string(bodyText))
-		return "", err
+		return nil, fmt.Errorf("restAPI Read failed with http error: %s, url: %s", err, r.redactRawURL(url))
 	}
 
-	// Update BaseUrl to instance url
-	r.BaseURL = strings.TrimSuffix(authResponse.InstanceURL, "/")
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("restAPI Read failed with http error: %s, %s, url: %s", resp.Status, body, r.redactRawURL(url))
+	}
+
+	return &recordCountingBody{ReadCloser: resp.Body, r: r, counter: newRecordCounter(r.setConfig.recordsPath())}, nil
+}
+
+// pageReader reads the pages written by writePages. Close stops the page requests and waits for
+// them to finish, so that no events are logged after the read is complete.
+type pageReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (p *pageReader) Close() error {
+	err := p.PipeReader.Close()
+	<-p.done
+	return err
+}
 
-	return authResponse.AccessToken, nil
+// hasKey returns true if the JSON object has the key, matched without regard to case as
+// json.Unmarshal does
+func hasKey(data json.RawMessage, key string) bool {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return false
+	}
+	for k := range object {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *RestAPI) setDefaults() {
@@ -158,15 +316,70 @@ func (r *RestAPI) setDefaults() {
 	if r.BatchSize <= 0 {
 		r.BatchSize = DefaultBatchSize
 	}
-	if r.BatchDelaySeconds <= 0 {
-		r.BatchDelaySeconds = DefaultBatchDelaySeconds
-	}
 	if r.UserAgent == "" {
 		r.UserAgent = "rest-data-archiver"
 	}
 }
 
 func (r *RestAPI) httpRequest(verb, url, body string, headers map[string]string) ([]byte, error) {
+	bodyBytes, _, err := r.request(verb, url, body, headers)
+	return bodyBytes, err
+}
+
+// request makes an http request and returns the response body and headers
+func (r *RestAPI) request(verb, url, body string, headers map[string]string) ([]byte, http.Header, error) {
+	resp, err := r.send(verb, url, body, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read http response body: %s", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return bodyBytes, resp.Header, errors.New(resp.Status)
+	}
+
+	return bodyBytes, resp.Header, nil
+}
+
+// send makes an http request, retrying according to the RetryPolicy, and returns the response.
+// If an OAuth token is rejected, a new token is requested and the request is tried once more.
+// The caller must close the response body.
+func (r *RestAPI) send(verb, url, body string, headers map[string]string) (*http.Response, error) {
+	var token string
+	newRequest := func() (*http.Request, error) {
+		req, err := r.newRequest(verb, url, body, headers)
+		if err == nil {
+			token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		}
+		return req, err
+	}
+
+	resp, err := r.doWithRetry(r.httpClient(), newRequest)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && r.oauth != nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		r.logEvent(syslog.LOG_WARNING, fmt.Sprintf("%s %s was not authorized, requesting a new OAuth token", verb, r.redactRawURL(url)))
+		r.oauth.invalidate(token)
+		resp, err = r.doWithRetry(r.httpClient(), newRequest)
+	}
+
+	if err == nil {
+		r.recordRequest(url, resp.StatusCode)
+	}
+	return resp, err
+}
+
+// SetEventLog provides the event log used to report retries
+func (r *RestAPI) SetEventLog(eventLog chan<- internal.EventLogItem) {
+	r.eventLog = eventLog
+}
+
+func (r *RestAPI) newRequest(verb, url, body string, headers map[string]string) (*http.Request, error) {
 	var req *http.Request
 	var err error
 	if body == "" {
@@ -186,25 +399,19 @@ func (r *RestAPI) httpRequest(verb, url, body string, headers map[string]string)
 	switch r.AuthType {
 	case AuthTypeBasic:
 		req.SetBasicAuth(r.Username, r.Password)
-	case AuthTypeBearer, AuthTypeSalesforceOauth:
+	case AuthTypeBearer:
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", r.Password))
+	case AuthTypeAPIKey:
+		r.setAPIKey(req)
+	case AuthTypeOAuth2, AuthTypeSalesforceOauth:
+		token := r.Password
+		if r.oauth != nil {
+			if token, err = r.oauth.token(r); err != nil {
+				return nil, err
+			}
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read http response body: %s", err)
-	}
-
-	if resp.StatusCode >= 400 {
-		return bodyBytes, errors.New(resp.Status)
-	}
-
-	return bodyBytes, nil
+	return req, nil
 }
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 )
 
 type fakeEndpoint struct {
@@ -205,3 +207,68 @@ func getTestServer() *httptest.Server {
 	}
 	return httptest.NewServer(mux)
 }
+
+// getPaginationTestServer returns a server with an endpoint for each pagination type. Each
+// endpoint returns three records in two pages.
+func getPaginationTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/array", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `[{"id":1},{"id":2}]`)
+	})
+	mux.HandleFunc("/next", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("page") == "2" {
+			_, _ = io.WriteString(w, `{"done":true,"records":[{"id":3}]}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"done":false,"nextRecordsUrl":"/next?page=2","records":[{"id":1},{"id":2}]}`)
+	})
+	mux.HandleFunc("/link", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("page") == "2" {
+			w.Header().Set("Link", `</link?page=1>; rel="prev"`)
+			_, _ = io.WriteString(w, `[{"id":3}]`)
+			return
+		}
+		w.Header().Set("Link", `</link?page=1>; rel="first", </link?page=2>; rel="next"`)
+		_, _ = io.WriteString(w, `[{"id":1},{"id":2}]`)
+	})
+	mux.HandleFunc("/offset", func(w http.ResponseWriter, req *http.Request) {
+		records := []string{`{"id":1}`, `{"id":2}`, `{"id":3}`}
+		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		end := offset + limit
+		if end > len(records) {
+			end = len(records)
+		}
+		if offset > end {
+			offset = end
+		}
+		_, _ = io.WriteString(w, `{"data":[`+strings.Join(records[offset:end], ",")+`]}`)
+	})
+	mux.HandleFunc("/capped", func(w http.ResponseWriter, req *http.Request) {
+		// returns no more than one record, whatever the limit
+		records := []string{`{"id":1}`, `{"id":2}`, `{"id":3}`}
+		offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+		if offset >= len(records) {
+			_, _ = io.WriteString(w, `{"data":[]}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"data":[`+records[offset]+`]}`)
+	})
+	mux.HandleFunc("/numbers", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `{"records":[{"id":9007199254740993,"amount":1.10},{"id":1e3}]}`)
+	})
+	mux.HandleFunc("/renamed", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `{"results":[{"id":1}]}`)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `{"nextRecordsUrl":"/loop?page=2","records":[{"id":1}]}`)
+	})
+	mux.HandleFunc("/cursor", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("cursor") == "abc" {
+			_, _ = io.WriteString(w, `{"data":[{"id":3}],"meta":{"next_cursor":null}}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"data":[{"id":1},{"id":2}],"meta":{"next_cursor":"abc"}}`)
+	})
+	return httptest.NewServer(mux)
+}
@@ -1,9 +1,24 @@
 package restapi
 
 import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/silinternational/rest-data-archiver/internal"
 )
 
 func TestRestAPI_httpRequest(t *testing.T) {
@@ -107,3 +122,1117 @@ func TestRestAPI_httpRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestRestAPI_Read_Pagination(t *testing.T) {
+	server := getPaginationTestServer()
+
+	tests := []struct {
+		name       string
+		path       string
+		pagination Pagination
+		maxPages   int
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "no pagination",
+			path: "/array",
+			want: `[{"id":1},{"id":2}]`,
+		},
+		{
+			name: "next url",
+			path: "/next",
+			pagination: Pagination{
+				Type:        PaginationNextURL,
+				RecordsPath: "records",
+				NextURLPath: "nextRecordsUrl",
+			},
+			want: `[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			name:       "link header",
+			path:       "/link",
+			pagination: Pagination{Type: PaginationLinkHeader},
+			want:       `[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			name:       "offset",
+			path:       "/offset",
+			pagination: Pagination{Type: PaginationOffset, RecordsPath: "$.data"},
+			want:       `[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			name:       "offset with a page size limited by the API",
+			path:       "/capped",
+			pagination: Pagination{Type: PaginationOffset, RecordsPath: "data"},
+			want:       `[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			name:       "numbers are not changed",
+			path:       "/numbers",
+			pagination: Pagination{Type: PaginationLinkHeader, RecordsPath: "records"},
+			want:       `[{"id":9007199254740993,"amount":1.10},{"id":1e3}]`,
+		},
+		{
+			name:       "missing records path",
+			path:       "/renamed",
+			pagination: Pagination{Type: PaginationOffset, RecordsPath: "data"},
+			wantErr:    "no records found at 'data'",
+		},
+		{
+			name: "repeated next url",
+			path: "/loop",
+			pagination: Pagination{
+				Type:        PaginationNextURL,
+				RecordsPath: "records",
+				NextURLPath: "nextRecordsUrl",
+			},
+			wantErr: "page 3 from " + server.URL + "/loop?page=2 was already requested",
+		},
+		{
+			name: "cursor",
+			path: "/cursor",
+			pagination: Pagination{
+				Type:        PaginationCursor,
+				RecordsPath: "data",
+				CursorPath:  "meta.next_cursor",
+				CursorParam: "cursor",
+			},
+			want: `[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			name: "max pages",
+			path: "/cursor",
+			pagination: Pagination{
+				Type:        PaginationCursor,
+				RecordsPath: "data",
+				CursorPath:  "meta.next_cursor",
+				CursorParam: "cursor",
+				MaxPages:    1,
+			},
+			want: `[{"id":1},{"id":2}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := RestAPI{RequestMethod: http.MethodGet, BaseURL: server.URL, BatchSize: 2}
+			setJSON, _ := json.Marshal(SetConfig{Path: tt.path, Pagination: tt.pagination})
+			source, err := r.ForSet("test", setJSON)
+			require.NoError(t, err)
+
+			got, err := source.Read()
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestRestAPI_ReadStream(t *testing.T) {
+	server := getPaginationTestServer()
+
+	tests := []struct {
+		name       string
+		path       string
+		pagination Pagination
+		want       string
+		wantErr    string
+	}{
+		{
+			name: "single request",
+			path: "/array",
+			want: `[{"id":1},{"id":2}]`,
+		},
+		{
+			name:       "paginated",
+			path:       "/link",
+			pagination: Pagination{Type: PaginationLinkHeader},
+			want:       `[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			name:    "not found",
+			path:    "/missing",
+			wantErr: "404 Not Found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := RestAPI{RequestMethod: http.MethodGet, BaseURL: server.URL, BatchSize: 2}
+			setJSON, _ := json.Marshal(SetConfig{Path: tt.path, Pagination: tt.pagination})
+			source, err := r.ForSet("test", setJSON)
+			require.NoError(t, err)
+
+			stream, err := source.(internal.StreamSource).ReadStream()
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer stream.Close()
+
+			got, err := ioutil.ReadAll(stream)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestRestAPI_httpRequest_Retry(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, `[{"id":1}]`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		retry        RetryPolicy
+		wantErr      string
+		wantAttempts int
+		wantEvents   int
+	}{
+		{
+			name:         "no retry",
+			retry:        RetryPolicy{},
+			wantErr:      "503 Service Unavailable",
+			wantAttempts: 1,
+		},
+		{
+			name:         "not enough attempts",
+			retry:        RetryPolicy{MaxAttempts: 2},
+			wantErr:      "503 Service Unavailable",
+			wantAttempts: 2,
+			wantEvents:   1,
+		},
+		{
+			name:         "success after retries",
+			retry:        RetryPolicy{MaxAttempts: 5},
+			wantAttempts: 3,
+			wantEvents:   2,
+		},
+		{
+			name:         "status not retryable",
+			retry:        RetryPolicy{MaxAttempts: 5, RetryableStatusCodes: []int{http.StatusTooManyRequests}},
+			wantErr:      "503 Service Unavailable",
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts = 0
+			eventLog := make(chan internal.EventLogItem, 10)
+			r := RestAPI{Retry: tt.retry, eventLog: eventLog}
+
+			got, err := r.httpRequest(http.MethodGet, server.URL, "", nil)
+			require.Equal(t, tt.wantAttempts, attempts)
+			require.Len(t, eventLog, tt.wantEvents)
+			for i := 0; i < tt.wantEvents; i++ {
+				event := <-eventLog
+				require.Equal(t, syslog.LOG_WARNING, event.Level)
+				require.Contains(t, event.Message, "retrying")
+			}
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, `[{"id":1}]`, string(got))
+		})
+	}
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	policy := RetryPolicy{BaseDelaySeconds: 1, MaxDelaySeconds: 5}
+
+	require.Equal(t, time.Second, policy.delay(1, nil))
+	require.Equal(t, 4*time.Second, policy.delay(3, nil))
+	require.Equal(t, 5*time.Second, policy.delay(10, nil), "backoff should be capped")
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	require.Equal(t, 2*time.Second, policy.delay(3, resp), "Retry-After should take precedence")
+
+	resp.Header.Set("Retry-After", "120")
+	require.Equal(t, 5*time.Second, policy.delay(1, resp), "Retry-After should be capped")
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	require.Equal(t, 5*time.Second, policy.delay(1, resp), "HTTP date Retry-After should be parsed")
+
+	policy.Jitter = true
+	for i := 0; i < 10; i++ {
+		require.LessOrEqual(t, policy.delay(3, nil), 4*time.Second)
+	}
+}
+
+func Test_newHTTPClient(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = io.WriteString(w, `[]`)
+	}))
+	defer slow.Close()
+
+	stop := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `[{"id":1},`)
+		w.(http.Flusher).Flush()
+		<-stop
+	}))
+	defer stalled.Close()
+	defer close(stop)
+
+	trickle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `[`)
+		for i := 0; i < 5; i++ {
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			_, _ = io.WriteString(w, `{"id":1},`)
+		}
+		_, _ = io.WriteString(w, `{"id":2}]`)
+	}))
+	defer trickle.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, `[]`)
+	}))
+	defer secure.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caBundle, certPEM, 0o600))
+
+	tests := []struct {
+		name      string
+		config    HTTPClientConfig
+		url       string
+		wantErr   string
+		configErr string
+	}{
+		{
+			name:    "response timeout",
+			config:  HTTPClientConfig{ResponseTimeoutSeconds: 0.05},
+			url:     slow.URL,
+			wantErr: "timeout awaiting response headers",
+		},
+		{
+			name:    "overall timeout",
+			config:  HTTPClientConfig{TimeoutSeconds: 0.05},
+			url:     slow.URL,
+			wantErr: "Client.Timeout exceeded",
+		},
+		{
+			name:   "within timeout",
+			config: HTTPClientConfig{TimeoutSeconds: 5},
+			url:    slow.URL,
+		},
+		{
+			name:    "body idle timeout",
+			config:  HTTPClientConfig{BodyIdleTimeoutSeconds: 0.1},
+			url:     stalled.URL,
+			wantErr: "no data received from the response body",
+		},
+		{
+			name:   "body slower than the idle timeout in total",
+			config: HTTPClientConfig{BodyIdleTimeoutSeconds: 0.15},
+			url:    trickle.URL,
+		},
+		{
+			name:    "untrusted certificate",
+			config:  HTTPClientConfig{},
+			url:     secure.URL,
+			wantErr: "certificate",
+		},
+		{
+			name:   "custom CA bundle",
+			config: HTTPClientConfig{CABundleFile: caBundle},
+			url:    secure.URL,
+		},
+		{
+			name:      "bad TLS version",
+			config:    HTTPClientConfig{TLSMinVersion: "2.0"},
+			configErr: "unrecognized TLSMinVersion",
+		},
+		{
+			name:      "missing client certificate",
+			config:    HTTPClientConfig{ClientCertFile: "missing.pem", ClientKeyFile: "missing.key"},
+			configErr: "unable to load client certificate",
+		},
+	}
+	client, err := newHTTPClient(HTTPClientConfig{})
+	require.NoError(t, err)
+	require.Zero(t, client.Timeout, "large response bodies should not be cut off by default")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newHTTPClient(tt.config)
+			if tt.configErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.configErr)
+				return
+			}
+			require.NoError(t, err)
+
+			r := RestAPI{client: client}
+			_, err = r.httpRequest(http.MethodGet, tt.url, "", nil)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRestAPI_OAuth2(t *testing.T) {
+	var tokenRequests []url.Values
+	var tokenExpiresIn int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/token":
+			_ = req.ParseForm()
+			form := req.PostForm
+			if id, secret, ok := req.BasicAuth(); ok {
+				form.Set("basic", id+":"+secret)
+			}
+			tokenRequests = append(tokenRequests, form)
+			n := len(tokenRequests)
+			_, _ = fmt.Fprintf(w, `{"access_token":"token%d","expires_in":%d,"refresh_token":"refresh%d","instance_url":"http://%s/"}`,
+				n, tokenExpiresIn, n, req.Host)
+		case "/data":
+			// only the most recent token is accepted
+			if req.Header.Get("Authorization") != fmt.Sprintf("Bearer token%d", len(tokenRequests)) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = io.WriteString(w, `[{"id":1}]`)
+		}
+	}))
+	defer server.Close()
+
+	newSource := func(t *testing.T, config map[string]interface{}) *RestAPI {
+		adapterConfig, err := json.Marshal(config)
+		require.NoError(t, err)
+		source, err := NewRestAPISource(internal.SourceConfig{AdapterConfig: adapterConfig})
+		require.NoError(t, err)
+		return source.(*RestAPI)
+	}
+
+	t.Run("client credentials", func(t *testing.T) {
+		tokenRequests, tokenExpiresIn = nil, 3600
+		r := newSource(t, map[string]interface{}{
+			"BaseURL":      server.URL,
+			"AuthType":     AuthTypeOAuth2,
+			"ClientID":     "id",
+			"ClientSecret": "secret",
+			"OAuth2": OAuth2Config{
+				TokenURL: server.URL + "/token",
+				Scopes:   []string{"read", "write"},
+				Audience: "api",
+			},
+		})
+
+		for i := 0; i < 2; i++ {
+			got, err := r.httpRequest(http.MethodGet, server.URL+"/data", "", nil)
+			require.NoError(t, err)
+			require.Equal(t, `[{"id":1}]`, string(got))
+		}
+		require.Len(t, tokenRequests, 1, "token should be reused until it expires")
+		require.Equal(t, GrantTypeClientCredentials, tokenRequests[0].Get("grant_type"))
+		require.Equal(t, "read write", tokenRequests[0].Get("scope"))
+		require.Equal(t, "api", tokenRequests[0].Get("audience"))
+		require.Equal(t, "id:secret", tokenRequests[0].Get("basic"))
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		tokenRequests, tokenExpiresIn = nil, 30
+		r := newSource(t, map[string]interface{}{
+			"AuthType": AuthTypeOAuth2,
+			"OAuth2":   OAuth2Config{TokenURL: server.URL + "/token"},
+		})
+
+		_, err := r.httpRequest(http.MethodGet, server.URL+"/data", "", nil)
+		require.NoError(t, err)
+		require.Len(t, tokenRequests, 2, "token expiring within the margin should be refreshed")
+	})
+
+	t.Run("rejected token", func(t *testing.T) {
+		tokenRequests, tokenExpiresIn = nil, 0
+		eventLog := make(chan internal.EventLogItem, 10)
+		r := newSource(t, map[string]interface{}{
+			"AuthType": AuthTypeOAuth2,
+			"OAuth2":   OAuth2Config{TokenURL: server.URL + "/token"},
+		})
+		r.SetEventLog(eventLog)
+
+		// another token is issued, so the cached one is no longer accepted
+		tokenRequests = append(tokenRequests, url.Values{})
+
+		got, err := r.httpRequest(http.MethodGet, server.URL+"/data", "", nil)
+		require.NoError(t, err)
+		require.Equal(t, `[{"id":1}]`, string(got))
+		require.Len(t, tokenRequests, 3)
+		require.Len(t, eventLog, 1)
+	})
+
+	t.Run("refresh token", func(t *testing.T) {
+		tokenRequests, tokenExpiresIn = nil, 30
+		r := newSource(t, map[string]interface{}{
+			"AuthType":     AuthTypeOAuth2,
+			"ClientID":     "id",
+			"ClientSecret": "secret",
+			"OAuth2": OAuth2Config{
+				TokenURL:     server.URL + "/token",
+				GrantType:    GrantTypeRefreshToken,
+				RefreshToken: "refresh0",
+				ClientAuth:   ClientAuthBody,
+			},
+		})
+
+		_, err := r.httpRequest(http.MethodGet, server.URL+"/data", "", nil)
+		require.NoError(t, err)
+		require.Len(t, tokenRequests, 2)
+		require.Equal(t, "refresh0", tokenRequests[0].Get("refresh_token"))
+		require.Equal(t, "refresh1", tokenRequests[1].Get("refresh_token"), "refresh token should be rotated")
+		require.Equal(t, "id", tokenRequests[1].Get("client_id"))
+		require.Equal(t, "secret", tokenRequests[1].Get("client_secret"))
+		require.Empty(t, tokenRequests[1].Get("basic"))
+	})
+
+	t.Run("salesforce", func(t *testing.T) {
+		tokenRequests, tokenExpiresIn = nil, 0
+		r := newSource(t, map[string]interface{}{
+			"BaseURL":  server.URL + "/token",
+			"AuthType": AuthTypeSalesforceOauth,
+			"Username": "user",
+			"Password": "pass",
+		})
+
+		require.Equal(t, server.URL, r.BaseURL)
+		require.Equal(t, GrantTypePassword, tokenRequests[0].Get("grant_type"))
+		require.Equal(t, "user", tokenRequests[0].Get("username"))
+		require.Equal(t, "pass", tokenRequests[0].Get("password"))
+
+		setSource, err := r.ForSet("set", json.RawMessage(`{"Path":"/data"}`))
+		require.NoError(t, err)
+		got, err := setSource.Read()
+		require.NoError(t, err)
+		require.Equal(t, `[{"id":1}]`, string(got))
+	})
+
+	t.Run("missing token URL", func(t *testing.T) {
+		_, err := NewRestAPISource(internal.SourceConfig{AdapterConfig: []byte(`{"AuthType":"oauth2"}`)})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "TokenURL")
+	})
+}
+
+func TestRestAPI_APIKeyAndHeaders(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+		_, _ = io.WriteString(w, `[]`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		config      string
+		set         string
+		wantHeaders map[string]string
+		wantQuery   string
+		wantErr     string
+	}{
+		{
+			name:        "header",
+			config:      `{"AuthType":"apikey","Password":"key"}`,
+			set:         `{"Path":"/data"}`,
+			wantHeaders: map[string]string{"X-API-Key": "key", "Content-Type": "application/json"},
+		},
+		{
+			name:        "custom header",
+			config:      `{"AuthType":"apikey","Password":"key","APIKey":{"Name":"Api-Token"}}`,
+			set:         `{"Path":"/data"}`,
+			wantHeaders: map[string]string{"Api-Token": "key", "X-API-Key": ""},
+		},
+		{
+			name:      "query",
+			config:    `{"AuthType":"apikey","Password":"k&y","APIKey":{"In":"query"}}`,
+			set:       `{"Path":"/data?q=1"}`,
+			wantQuery: "q=1&api_key=k%26y",
+		},
+		{
+			name:    "bad placement",
+			config:  `{"AuthType":"apikey","Password":"key","APIKey":{"In":"cookie"}}`,
+			wantErr: "unrecognized APIKey In 'cookie'",
+		},
+		{
+			name:   "adapter and set headers",
+			config: `{"Headers":{"Accept":"application/vnd.foo+json","X-Tenant":"a"}}`,
+			set:    `{"Path":"/data","Headers":{"X-Tenant":"b","Content-Type":"text/plain"}}`,
+			wantHeaders: map[string]string{
+				"Accept":       "application/vnd.foo+json",
+				"X-Tenant":     "b",
+				"Content-Type": "text/plain",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := strings.Replace(tt.config, "{", `{"BaseURL":"`+server.URL+`",`, 1)
+			source, err := NewRestAPISource(internal.SourceConfig{AdapterConfig: []byte(config)})
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			setSource, err := source.ForSet("set", json.RawMessage(tt.set))
+			require.NoError(t, err)
+			_, err = setSource.Read()
+			require.NoError(t, err)
+
+			for k, v := range tt.wantHeaders {
+				require.Equal(t, v, got.Header.Get(k), k)
+			}
+			if tt.wantQuery != "" {
+				require.Equal(t, tt.wantQuery, got.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func TestNewRestAPISource_BatchDefaults(t *testing.T) {
+	tests := []struct {
+		config    string
+		wantSize  int
+		wantDelay int
+	}{
+		{config: `{}`, wantSize: DefaultBatchSize, wantDelay: DefaultBatchDelaySeconds},
+		{config: `{"BatchSize":50,"BatchDelaySeconds":0}`, wantSize: 50, wantDelay: 0},
+		{config: `{"batchDelaySeconds":1}`, wantSize: DefaultBatchSize, wantDelay: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			source, err := NewRestAPISource(internal.SourceConfig{AdapterConfig: []byte(tt.config)})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSize, source.(*RestAPI).BatchSize)
+			require.Equal(t, tt.wantDelay, source.(*RestAPI).BatchDelaySeconds)
+		})
+	}
+}
+
+func TestRestAPI_redactURL(t *testing.T) {
+	r := RestAPI{AuthType: AuthTypeAPIKey, Password: "secret", APIKey: APIKeyConfig{In: APIKeyInQuery, Name: "key"}}
+	u, _ := url.Parse("https://example.com/data?key=secret&page=2")
+	require.Equal(t, "https://example.com/data?key=xxxxx&page=2", r.redactURL(u))
+}
+
+func TestRestAPI_Read_ConnectionErrorRedactsAPIKey(t *testing.T) {
+	// Get the URL of a port that is no longer listening
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	const key = "SUPERSECRETKEY"
+	config := `{"BaseURL":"` + server.URL + `","AuthType":"apikey","Password":"` + key + `",` +
+		`"APIKey":{"In":"query"},"Retry":{"MaxAttempts":2,"BaseDelaySeconds":0.001,"RetryNetworkErrors":true}}`
+	source, err := NewRestAPISource(internal.SourceConfig{AdapterConfig: []byte(config)})
+	require.NoError(t, err)
+
+	for _, set := range []string{`{"Path":"/x"}`, `{"Path":"/x","Pagination":{"Type":"LinkHeader"}}`} {
+		setSource, err := source.ForSet("set", json.RawMessage(set))
+		require.NoError(t, err)
+		eventLog := make(chan internal.EventLogItem, 10)
+		setSource.(*RestAPI).SetEventLog(eventLog)
+
+		_, err = setSource.Read()
+		require.Error(t, err)
+		require.NotContains(t, err.Error(), key)
+		require.Contains(t, err.Error(), "api_key=xxxxx")
+
+		require.Len(t, eventLog, 1)
+		event := <-eventLog
+		require.NotContains(t, event.Message, key)
+	}
+	require.Equal(t, "key="+internal.RedactedText, internal.RedactSecrets("key="+key))
+}
+
+func TestRestAPI_Read_BodyAndQuery(t *testing.T) {
+	var gotMethod, gotQuery, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		gotMethod, gotQuery, gotBody = req.Method, req.URL.RawQuery, string(body)
+		_, _ = io.WriteString(w, `[]`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		set       string
+		wantQuery string
+		wantBody  string
+		wantErr   string
+	}{
+		{
+			name:      "query",
+			set:       `{"Path":"/search?x=1","Query":{"q":"SELECT Name FROM Contact","b":"&"}}`,
+			wantQuery: "x=1&b=%26&q=SELECT+Name+FROM+Contact",
+		},
+		{
+			name:     "JSON body",
+			set:      `{"Path":"/search","Body":{"filter":{"active":true}}}`,
+			wantBody: `{"filter":{"active":true}}`,
+		},
+		{
+			name:     "raw body",
+			set:      `{"Path":"/search","Body":"name=a&type=b"}`,
+			wantBody: "name=a&type=b",
+		},
+		{
+			name:    "GraphQL without a query",
+			set:     `{"Path":"/graphql","GraphQL":{}}`,
+			wantErr: "GraphQL requires a Query",
+		},
+		{
+			name:    "GraphQL with LinkHeader pagination",
+			set:     `{"Path":"/graphql","GraphQL":{"Query":"{a}"},"Pagination":{"Type":"LinkHeader"}}`,
+			wantErr: "cannot be used with GraphQL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RestAPI{BaseURL: server.URL, RequestMethod: http.MethodPost}
+			setSource, err := r.ForSet("set", json.RawMessage(tt.set))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			_, err = setSource.Read()
+			require.NoError(t, err)
+			require.Equal(t, http.MethodPost, gotMethod)
+			require.Equal(t, tt.wantQuery, gotQuery)
+			require.Equal(t, tt.wantBody, gotBody)
+		})
+	}
+}
+
+func TestRestAPI_Read_GraphQL(t *testing.T) {
+	type graphQLRequest struct {
+		Query     string
+		Variables map[string]interface{}
+	}
+	var requests []graphQLRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var gqlRequest graphQLRequest
+		_ = json.NewDecoder(req.Body).Decode(&gqlRequest)
+		requests = append(requests, gqlRequest)
+
+		if gqlRequest.Variables["fail"] == true {
+			_, _ = io.WriteString(w, `{"data":null,"errors":[{"message":"field 'x' not found"}]}`)
+			return
+		}
+		switch gqlRequest.Variables["after"] {
+		case nil:
+			_, _ = io.WriteString(w, `{"data":{"users":{"nodes":[{"id":1},{"id":2}],"pageInfo":{"endCursor":"c2"}}}}`)
+		case "c2":
+			_, _ = io.WriteString(w, `{"data":{"users":{"nodes":[{"id":3}],"pageInfo":{"endCursor":null}}}}`)
+		}
+	}))
+	defer server.Close()
+
+	r := &RestAPI{BaseURL: server.URL, BatchSize: 2}
+	setSource, err := r.ForSet("set", json.RawMessage(`{
+		"Path": "/graphql",
+		"GraphQL": {
+			"Query": "query($first: Int, $after: String) { users(first: $first, after: $after) { nodes { id } } }",
+			"Variables": {"org": "a"}
+		},
+		"Pagination": {
+			"Type": "Cursor",
+			"RecordsPath": "data.users.nodes",
+			"CursorPath": "data.users.pageInfo.endCursor",
+			"CursorParam": "after",
+			"LimitParam": "first"
+		}
+	}`))
+	require.NoError(t, err)
+
+	got, err := setSource.Read()
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"id":1},{"id":2},{"id":3}]`, string(got))
+	require.Len(t, requests, 2)
+	require.Contains(t, requests[0].Query, "users(first: $first")
+	require.Equal(t, map[string]interface{}{"org": "a", "first": float64(2)}, requests[0].Variables)
+	require.Equal(t, map[string]interface{}{"org": "a", "first": float64(2), "after": "c2"}, requests[1].Variables)
+
+	setSource, err = r.ForSet("set", json.RawMessage(`{"Path":"/graphql","GraphQL":{"Query":"{x}","Variables":{"fail":true}}}`))
+	require.NoError(t, err)
+	_, err = setSource.(internal.StreamSource).ReadStream()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "field 'x' not found")
+}
+
+func TestRestAPI_SetState(t *testing.T) {
+	var gotPath, gotQuery, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		gotPath, gotQuery, gotBody = req.URL.Path, req.URL.RawQuery, string(body)
+		_, _ = io.WriteString(w, `[]`)
+	}))
+	defer server.Close()
+
+	r := &RestAPI{BaseURL: server.URL, RequestMethod: http.MethodPost}
+	source, err := r.ForSet("users", json.RawMessage(`{
+		"Path": "/reports/{{ .Now | date \"2006-01-02\" }}/{{ .SetName }}",
+		"Query": {"since": "{{ .LastRunTime | default (.Now | add \"-24h\") | date \"RFC3339\" }}"},
+		"Body": {"filter": {"after": "{{ .LastRunTime | date \"Unix\" }}", "limit": 100}}
+	}`))
+	require.NoError(t, err)
+
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	lastRun := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, source.(internal.StatefulSource).SetState(now, internal.SetState{LastRunTime: lastRun}))
+
+	_, err = source.Read()
+	require.NoError(t, err)
+	require.Equal(t, "/reports/2021-03-04/users", gotPath)
+	require.Equal(t, "since=2021-03-01T00%3A00%3A00Z", gotQuery)
+	require.JSONEq(t, `{"filter":{"after":"1614556800","limit":100}}`, gotBody)
+
+	_, err = r.ForSet("users", json.RawMessage(`{"Path": "/{{ .Nope }}"}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Nope")
+}
+
+func TestRestAPI_Watermark(t *testing.T) {
+	var gotQueries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotQueries = append(gotQueries, req.URL.Query().Get("since"))
+		switch req.URL.Query().Get("page") {
+		case "":
+			_, _ = io.WriteString(w, `{"records":[{"id":1,"modified":"2021-03-01T10:00:00Z"},{"id":2,"modified":"2021-03-02T09:00:00+01:00"}],"next":"?page=2"}`)
+		case "2":
+			_, _ = io.WriteString(w, `{"records":[{"id":3,"modified":"2021-02-01T00:00:00Z"},{"id":4}]}`)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name  string
+		set   string
+		saved string
+		want  string
+	}{
+		{
+			name: "paginated",
+			set: `{"Path":"/r","Query":{"since":"{{ .Watermark }}"},
+				"Pagination":{"Type":"NextURL","RecordsPath":"records","NextURLPath":"next"},
+				"Watermark":{"Path":"modified"}}`,
+			saved: "2021-01-01T00:00:00Z",
+			want:  "2021-03-02T09:00:00+01:00",
+		},
+		{
+			name:  "not paginated",
+			set:   `{"Path":"/r?page=2","Query":{"since":"{{ .Watermark }}"},"Watermark":{"Path":"modified","RecordsPath":"records"}}`,
+			saved: "2021-01-01T00:00:00Z",
+			want:  "2021-02-01T00:00:00Z",
+		},
+		{
+			name:  "never moves backwards",
+			set:   `{"Path":"/r?page=2","Watermark":{"Path":"modified","RecordsPath":"records"}}`,
+			saved: "2022-01-01T00:00:00Z",
+			want:  "2022-01-01T00:00:00Z",
+		},
+		{
+			name:  "run time",
+			set:   `{"Path":"/r?page=2","Watermark":{}}`,
+			saved: "2021-01-01T00:00:00Z",
+			want:  "2021-03-04T05:06:07Z",
+		},
+		{
+			name: "no watermark",
+			set:  `{"Path":"/r?page=2"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotQueries = nil
+			r := &RestAPI{BaseURL: server.URL}
+			source, err := r.ForSet("set", json.RawMessage(tt.set))
+			require.NoError(t, err)
+			require.NoError(t, source.(internal.StatefulSource).SetState(now, internal.SetState{Watermark: tt.saved}))
+
+			stream, err := source.(internal.StreamSource).ReadStream()
+			require.NoError(t, err)
+			if tt.name == "RecordsPath" {
+				require.IsType(t, &recordCountingBody{}, stream, "the response should be streamed")
+			}
+			_, err = io.Copy(ioutil.Discard, stream)
+			require.NoError(t, err)
+			require.NoError(t, stream.Close())
+
+			require.Equal(t, tt.want, source.(internal.WatermarkSource).Watermark())
+			if strings.Contains(tt.set, "since") {
+				require.Equal(t, tt.saved, gotQueries[0])
+			}
+		})
+	}
+}
+
+func Test_compareWatermarks(t *testing.T) {
+	require.Equal(t, 1, compareWatermarks("10", "9"))
+	require.Equal(t, 1, compareWatermarks("9007199254740993", "9007199254740992"))
+	require.Equal(t, 1, compareWatermarks("1.5", "1"))
+	require.Equal(t, -1, compareWatermarks("2021-03-02T09:00:00+01:00", "2021-03-02T08:30:00Z"))
+	require.Equal(t, 0, compareWatermarks("2021-03-02T08:00:00Z", "2021-03-02T09:00:00+01:00"))
+	require.Equal(t, 1, compareWatermarks("b", "a"))
+}
+
+func Test_watermarkTracker_observe(t *testing.T) {
+	w := &watermarkTracker{path: "id"}
+	require.NoError(t, w.observe(json.RawMessage(`{"id":9007199254740993}`)))
+	require.NoError(t, w.observe(json.RawMessage(`{"id":9007199254740992}`)))
+	require.Equal(t, "9007199254740993", w.get())
+}
+
+func TestRestAPI_Validation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/login":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, `<html>Please log in</html>`)
+		case "/error":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_, _ = io.WriteString(w, `{"error":"rate limited"}`)
+		case "/users":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_, _ = io.WriteString(w, `{"users":[{"id":1},{"id":2}]}`)
+		}
+	}))
+	defer server.Close()
+
+	schema := `{"type":"object","required":["users"],"properties":{"users":{"type":"array"}}}`
+	schemaFile := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(schema), 0o600))
+
+	tests := []struct {
+		name     string
+		set      string
+		lastSize int64
+		dryRun   bool
+		wantErr  string
+	}{
+		{
+			name:    "content type",
+			set:     `{"Path":"/login","Validation":{"ContentType":"application/json"}}`,
+			wantErr: "response Content-Type is 'text/html', not 'application/json'",
+		},
+		{
+			name:    "invalid JSON",
+			set:     `{"Path":"/login","Validation":{"RequireJSON":true}}`,
+			wantErr: "response is not valid JSON",
+		},
+		{
+			name:    "schema",
+			set:     `{"Path":"/error","Validation":{"Schema":` + schema + `}}`,
+			wantErr: "does not match the JSON Schema",
+		},
+		{
+			name:    "schema file",
+			set:     `{"Path":"/error","Validation":{"SchemaFile":"` + filepath.ToSlash(schemaFile) + `"}}`,
+			wantErr: "does not match the JSON Schema",
+		},
+		{
+			name:    "dry run",
+			set:     `{"Path":"/login","Validation":{"ContentType":"application/json"}}`,
+			dryRun:  true,
+			wantErr: "response Content-Type is 'text/html', not 'application/json'",
+		},
+		{
+			name:    "too few records",
+			set:     `{"Path":"/users","Validation":{"MinRecords":3,"RecordsPath":"users"}}`,
+			wantErr: "response has 2 records, fewer than the minimum of 3",
+		},
+		{
+			name:     "shrink",
+			set:      `{"Path":"/users","Validation":{"MaxShrinkPercent":50}}`,
+			lastSize: 100,
+			wantErr:  "% smaller than the 100 bytes of the last run",
+		},
+		{
+			name:     "valid",
+			set:      `{"Path":"/users","Validation":{"ContentType":"application/json","Schema":` + schema + `,"MinRecords":2,"RecordsPath":"users","MaxShrinkPercent":50}}`,
+			lastSize: 40,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventLog := make(chan internal.EventLogItem, 10)
+			r := &RestAPI{BaseURL: server.URL, eventLog: eventLog, hasStateStore: true, dryRunMode: tt.dryRun}
+			source, err := r.ForSet("set", json.RawMessage(tt.set))
+			require.NoError(t, err)
+			require.NoError(t, source.(internal.StatefulSource).SetState(time.Now(), internal.SetState{Size: tt.lastSize}))
+
+			stream, err := source.(internal.StreamSource).ReadStream()
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				got, _ := ioutil.ReadAll(stream)
+				require.Equal(t, `{"users":[{"id":1},{"id":2}]}`, string(got))
+				require.Len(t, eventLog, 0)
+				return
+			}
+
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+			require.True(t, internal.IsAlerted(err), "the failure should not be alerted again")
+			require.Len(t, eventLog, 1)
+			event := <-eventLog
+			if tt.dryRun {
+				require.Equal(t, syslog.LOG_WARNING, event.Level, "a dry run should not send alerts")
+			} else {
+				require.Equal(t, syslog.LOG_ALERT, event.Level)
+			}
+			require.Contains(t, event.Message, tt.wantErr)
+		})
+	}
+
+	r := &RestAPI{BaseURL: server.URL}
+	_, err := r.ForSet("set", json.RawMessage(`{"Path":"/users","Validation":{"Schema":{"type":7}}}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid JSON Schema")
+
+	_, err = r.ForSet("set", json.RawMessage(`{"Path":"/users","Validation":{"MaxShrinkPercent":50}}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "MaxShrinkPercent requires a State store")
+}
+
+func TestRestAPI_SourceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/array" {
+			_, _ = io.WriteString(w, `[{"id":1,"tags":["a","b"]}, {"id":"2,]"}, [3]]`)
+			return
+		}
+		switch req.URL.Query().Get("page") {
+		case "":
+			_, _ = io.WriteString(w, `{"records":[{"id":1},{"id":2}],"next":"?page=2"}`)
+		case "2":
+			_, _ = io.WriteString(w, `{"records":[{"id":3}]}`)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		set  string
+		want map[string]string
+	}{
+		{
+			name: "paginated",
+			set:  `{"Path":"/r","Pagination":{"Type":"NextURL","RecordsPath":"records","NextURLPath":"next"}}`,
+			want: map[string]string{"SourceURL": server.URL + "/r", "HTTPStatus": "200", "RecordCount": "3"},
+		},
+		{
+			name: "array",
+			set:  `{"Path":"/array"}`,
+			want: map[string]string{"SourceURL": server.URL + "/array", "HTTPStatus": "200", "RecordCount": "3"},
+		},
+		{
+			name: "RecordsPath",
+			set:  `{"Path":"/r","RecordsPath":"records"}`,
+			want: map[string]string{"SourceURL": server.URL + "/r", "HTTPStatus": "200", "RecordCount": "2"},
+		},
+		{
+			name: "validation RecordsPath",
+			set:  `{"Path":"/r","Validation":{"RecordsPath":"records"}}`,
+			want: map[string]string{"SourceURL": server.URL + "/r", "HTTPStatus": "200", "RecordCount": "2"},
+		},
+		{
+			name: "watermark RecordsPath",
+			set:  `{"Path":"/r","Watermark":{"Path":"id","RecordsPath":"records"}}`,
+			want: map[string]string{"SourceURL": server.URL + "/r", "HTTPStatus": "200", "RecordCount": "2"},
+		},
+		{
+			name: "records not found",
+			set:  `{"Path":"/r"}`,
+			want: map[string]string{"SourceURL": server.URL + "/r", "HTTPStatus": "200", "RecordCount": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RestAPI{BaseURL: server.URL, AuthType: AuthTypeAPIKey, Password: "secret-key",
+				APIKey: APIKeyConfig{In: APIKeyInQuery, Name: "key"}}
+			source, err := r.ForSet("set", json.RawMessage(tt.set))
+			require.NoError(t, err)
+			eventLog := make(chan internal.EventLogItem, 10)
+			source.(internal.EventLogger).SetEventLog(eventLog)
+
+			stream, err := source.(internal.StreamSource).ReadStream()
+			require.NoError(t, err)
+			if tt.name == "RecordsPath" {
+				require.IsType(t, &recordCountingBody{}, stream, "the response should be streamed")
+			}
+			_, err = io.Copy(ioutil.Discard, stream)
+			require.NoError(t, err)
+			require.NoError(t, stream.Close())
+
+			require.Equal(t, tt.want, source.(internal.MetadataSource).SourceMetadata())
+			require.Empty(t, eventLog)
+		})
+	}
+}
+
+func Test_recordCounter(t *testing.T) {
+	tests := []struct {
+		path   string
+		data   string
+		want   int
+		wantOK bool
+	}{
+		{data: `[]`, want: 0, wantOK: true},
+		{data: ` [ ] `, want: 0, wantOK: true},
+		{data: `[1]`, want: 1, wantOK: true},
+		{data: `[{"a":[1,2]},"x,\"]",null, true]`, want: 4, wantOK: true},
+		{data: `[[],[[]],{}]`, want: 3, wantOK: true},
+		{data: `{"records":[1,2]}`, wantOK: false},
+		{data: `[1,2`, wantOK: false},
+		{data: ``, wantOK: false},
+		{path: "records", data: `{"records":[1,2]}`, want: 2, wantOK: true},
+		{path: "records", data: `{"next":"[x]","other":{"records":[1]},"records":[{"records":[]},[3]]}`, want: 2, wantOK: true},
+		{path: "data.users", data: `{"data": {"count": 10, "users": [{"id":1}, {"id":2}, {"id":3}]}}`, want: 3, wantOK: true},
+		{path: "pages.1", data: `{"pages":[[1],[1,2]]}`, want: 2, wantOK: true},
+		{path: "records", data: `{"records":null}`, want: 0, wantOK: true},
+		{path: "a\"b", data: `{"a\u0022b":[1]}`, want: 1, wantOK: true},
+		{path: "records", data: `{"records":{"id":1}}`, wantOK: false},
+		{path: "records", data: `{"items":[1,2]}`, wantOK: false},
+		{path: "records", data: `[1,2]`, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.data, func(t *testing.T) {
+			// scan one byte at a time, as the data may be split between reads at any point
+			c := newRecordCounter(tt.path)
+			for i := range tt.data {
+				c.scan([]byte{tt.data[i]})
+			}
+			got, ok := c.count()
+			require.Equal(t, tt.wantOK, ok)
+			if ok {
+				require.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package restapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+const (
+	DefaultRetryBaseDelaySeconds = 1
+	DefaultRetryMaxDelaySeconds  = 60
+)
+
+// DefaultRetryableStatusCodes are retried if the RetryPolicy doesn't list any status codes
+var DefaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy configures how failed requests are retried. Retries are disabled unless
+// MaxAttempts is greater than 1.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts for each request, including the first
+	MaxAttempts int
+
+	// BaseDelaySeconds is the delay before the first retry, doubled for each further retry.
+	// Default: 1
+	BaseDelaySeconds float64
+
+	// MaxDelaySeconds caps the delay between attempts, including a delay requested by a
+	// Retry-After header. Default: 60
+	MaxDelaySeconds float64
+
+	// Jitter randomizes each delay between zero and the computed backoff ("full jitter")
+	Jitter bool
+
+	// RetryableStatusCodes are the response status codes that are retried.
+	// Default: 429, 502, 503, 504
+	RetryableStatusCodes []int
+
+	// RetryNetworkErrors enables retrying requests that fail without a response, such as
+	// connection failures and timeouts
+	RetryNetworkErrors bool
+}
+
+func (p *RetryPolicy) setDefaults() {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	if p.BaseDelaySeconds <= 0 {
+		p.BaseDelaySeconds = DefaultRetryBaseDelaySeconds
+	}
+	if p.MaxDelaySeconds <= 0 {
+		p.MaxDelaySeconds = DefaultRetryMaxDelaySeconds
+	}
+	if len(p.RetryableStatusCodes) == 0 {
+		p.RetryableStatusCodes = DefaultRetryableStatusCodes
+	}
+}
+
+func (p *RetryPolicy) isRetryableStatus(status int) bool {
+	for _, code := range p.RetryableStatusCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the time to wait before the given retry (1 for the first retry). A Retry-After
+// header in the response takes precedence over the computed backoff.
+func (p *RetryPolicy) delay(retry int, resp *http.Response) time.Duration {
+	maxDelay := seconds(p.MaxDelaySeconds)
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if retryAfter > maxDelay {
+				return maxDelay
+			}
+			return retryAfter
+		}
+	}
+
+	backoff := seconds(p.BaseDelaySeconds * math.Pow(2, float64(retry-1)))
+	if backoff > maxDelay || backoff <= 0 {
+		backoff = maxDelay
+	}
+	if p.Jitter {
+		backoff = time.Duration(rand.Int63n(int64(backoff) + 1))
+	}
+	return backoff
+}
+
+// parseRetryAfter parses a Retry-After header value, which is either a number of seconds or an
+// HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// doWithRetry sends the request built by newRequest, retrying according to the RetryPolicy. The
+// response to the last attempt is returned, even if its status is not successful.
+func (r *RestAPI) doWithRetry(client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	policy := r.Retry
+	policy.setDefaults()
+
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		err = r.redactError(err)
+		final := attempt >= policy.MaxAttempts
+		var reason string
+		switch {
+		case err != nil:
+			if final || !policy.RetryNetworkErrors || errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+			reason = err.Error()
+		case policy.isRetryableStatus(resp.StatusCode) && !final:
+			reason = resp.Status
+		default:
+			return resp, nil
+		}
+
+		wait := policy.delay(attempt, resp)
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		r.logEvent(syslog.LOG_WARNING, fmt.Sprintf("%s %s failed with %s, retrying in %s (attempt %d of %d)",
+			req.Method, r.redactURL(req.URL), reason, wait.Round(time.Millisecond), attempt+1, policy.MaxAttempts))
+		time.Sleep(wait)
+	}
+}
+
+// logEvent sends an event to the event log provided by RunSet, or to the standard logger if
+// there is none
+func (r *RestAPI) logEvent(level syslog.Priority, message string) {
+	item := internal.EventLogItem{Level: level, Message: message}
+	if r.eventLog == nil {
+		log.Println(item)
+		return
+	}
+	r.eventLog <- item
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,93 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// SetState renders the templates in the set's Path, Query, Body and GraphQL Variables with the
+// time of the run and the state kept from the last run, and starts tracking the set's watermark
+func (r *RestAPI) SetState(now time.Time, state internal.SetState) error {
+	r.lastSize = state.Size
+	return r.renderSet(internal.TemplateData{Now: now, LastRunTime: state.LastRunTime, Watermark: state.Watermark})
+}
+
+// renderSet renders the set's templates, unless they were already rendered by SetState
+func (r *RestAPI) renderSet(data internal.TemplateData) error {
+	if r.rendered {
+		return nil
+	}
+	if data.Now.IsZero() {
+		data.Now = time.Now()
+	}
+	data.SetName = r.setName
+
+	setConfig, err := r.setConfig.render(data)
+	if err != nil {
+		return fmt.Errorf("error in set '%s': %s", r.setName, err)
+	}
+	r.setConfig = setConfig
+	r.rendered = true
+	r.startWatermark(data.Now, data.Watermark)
+	return nil
+}
+
+// render returns a copy of the set config with its templates rendered
+func (s SetConfig) render(data internal.TemplateData) (SetConfig, error) {
+	var err error
+	if s.Path, err = internal.RenderTemplate(s.Path, data); err != nil {
+		return s, err
+	}
+
+	if s.Query != nil {
+		query := make(map[string]string, len(s.Query))
+		for k, v := range s.Query {
+			if query[k], err = internal.RenderTemplate(v, data); err != nil {
+				return s, err
+			}
+		}
+		s.Query = query
+	}
+
+	if len(s.Body) > 0 {
+		var body interface{}
+		decoder := json.NewDecoder(bytes.NewReader(s.Body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			return s, fmt.Errorf("Body is not valid JSON: %s", err)
+		}
+		if body, err = internal.RenderTemplates(body, data); err != nil {
+			return s, err
+		}
+		if s.Body, err = marshalJSON(body); err != nil {
+			return s, err
+		}
+	}
+
+	if s.GraphQL != nil {
+		variables, err := internal.RenderTemplates(s.GraphQL.Variables, data)
+		if err != nil {
+			return s, err
+		}
+		graphQL := *s.GraphQL
+		graphQL.Variables, _ = variables.(map[string]interface{})
+		s.GraphQL = &graphQL
+	}
+
+	return s, nil
+}
+
+// marshalJSON encodes the value without escaping HTML characters
+func marshalJSON(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
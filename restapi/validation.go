@@ -0,0 +1,138 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// ValidationConfig configures checks of a set's response before it is archived. A response that
+// fails any check is not archived, and the failure is logged as an alert.
+type ValidationConfig struct {
+	// ContentType is the required media type of the response, such as "application/json"
+	ContentType string
+
+	// RequireJSON requires the response to be valid JSON
+	RequireJSON bool
+
+	// Schema is a JSON Schema that the response must match, given inline or as the path of a
+	// file in SchemaFile
+	Schema     json.RawMessage
+	SchemaFile string
+
+	// MinRecords is the minimum number of records in the array at RecordsPath. If RecordsPath is
+	// empty, the response itself must be an array.
+	MinRecords  int
+	RecordsPath string
+
+	// MaxShrinkPercent is the largest decrease in the size of the response, compared to the last
+	// successful run, that is accepted. Zero disables the check.
+	MaxShrinkPercent float64
+
+	schema *jsonschema.Schema
+}
+
+func (v *ValidationConfig) init() error {
+	if v.MinRecords < 0 || v.MaxShrinkPercent < 0 {
+		return errors.New("MinRecords and MaxShrinkPercent must not be negative")
+	}
+	if len(v.Schema) > 0 && v.SchemaFile != "" {
+		return errors.New("only one of Schema and SchemaFile can be given")
+	}
+
+	compiler := jsonschema.NewCompiler()
+	var err error
+	switch {
+	case len(v.Schema) > 0:
+		if err = compiler.AddResource("schema.json", bytes.NewReader(v.Schema)); err == nil {
+			v.schema, err = compiler.Compile("schema.json")
+		}
+	case v.SchemaFile != "":
+		v.schema, err = compiler.Compile(v.SchemaFile)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid JSON Schema: %s", err)
+	}
+	return nil
+}
+
+// checkContentType returns an error if the response does not have the required media type
+func (v *ValidationConfig) checkContentType(header http.Header) error {
+	if v == nil || v.ContentType == "" {
+		return nil
+	}
+	contentType := header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.EqualFold(mediaType, v.ContentType) {
+		return fmt.Errorf("response Content-Type is '%s', not '%s'", contentType, v.ContentType)
+	}
+	return nil
+}
+
+// validate checks the complete response. lastSize is the size of the response archived in the
+// last successful run, or zero if unknown.
+func (v *ValidationConfig) validate(data []byte, lastSize int64) error {
+	if v.MaxShrinkPercent > 0 && lastSize > 0 {
+		shrink := float64(lastSize-int64(len(data))) / float64(lastSize) * 100
+		if shrink > v.MaxShrinkPercent {
+			return fmt.Errorf("response is %d bytes, %.1f%% smaller than the %d bytes of the last run",
+				len(data), shrink, lastSize)
+		}
+	}
+
+	if !v.RequireJSON && v.schema == nil && v.MinRecords == 0 {
+		return nil
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("response is not valid JSON: %s", err)
+	}
+	if decoder.More() {
+		return errors.New("response is not valid JSON: unexpected data after the JSON value")
+	}
+
+	if v.schema != nil {
+		if err := v.schema.Validate(doc); err != nil {
+			return fmt.Errorf("response does not match the JSON Schema: %s", err)
+		}
+	}
+
+	if v.MinRecords > 0 {
+		records := doc
+		if v.RecordsPath != "" {
+			records, _ = internal.GetJSONPath(doc, v.RecordsPath)
+		}
+		list, ok := records.([]interface{})
+		if !ok {
+			return fmt.Errorf("response has no array of records at '%s'", v.RecordsPath)
+		}
+		if len(list) < v.MinRecords {
+			return fmt.Errorf("response has %d records, fewer than the minimum of %d", len(list), v.MinRecords)
+		}
+	}
+	return nil
+}
+
+// validationFailed logs a validation failure as an alert, or as a warning in dry-run mode, and
+// returns it as an error that is not alerted again
+func (r *RestAPI) validationFailed(url string, err error) error {
+	message := fmt.Sprintf("response from %s failed validation and was not archived: %s", r.redactRawURL(url), err)
+	level := syslog.LOG_ALERT
+	if r.dryRunMode {
+		level = syslog.LOG_WARNING
+	}
+	r.logEvent(level, message)
+	return &internal.AlertedError{Err: errors.New(message)}
+}
@@ -0,0 +1,128 @@
+package restapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/silinternational/rest-data-archiver/internal"
+)
+
+// WatermarkConfig configures the high-water mark saved after each successful run of a set. The
+// saved watermark is available to the set's templates as ".Watermark", for example in a query
+// parameter that requests only the records modified since the last run.
+type WatermarkConfig struct {
+	// Path is the JSON path, within each record, of the value to track, such as
+	// "LastModifiedDate". The watermark is the greatest value of all records read. If empty, the
+	// watermark is the start time of the run.
+	Path string
+
+	// RecordsPath is the JSON path to the array of records in the response, for sets without
+	// pagination. If empty, the response itself must be an array. Paginated sets use the
+	// Pagination RecordsPath.
+	RecordsPath string
+}
+
+// watermarkTracker keeps the greatest value seen at the configured path
+type watermarkTracker struct {
+	path string
+
+	mu    sync.Mutex
+	value string
+}
+
+// observe updates the watermark with the value in the record, if it is greater
+func (w *watermarkTracker) observe(record json.RawMessage) error {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+	v, ok := internal.GetJSONPath(doc, w.path)
+	if !ok || v == nil {
+		return nil
+	}
+	value := fmt.Sprint(v)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.value == "" || compareWatermarks(value, w.value) > 0 {
+		w.value = value
+	}
+	return nil
+}
+
+func (w *watermarkTracker) get() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.value
+}
+
+// compareWatermarks compares two values as numbers if both are numeric, as times if both are
+// RFC 3339 times, or otherwise as strings. Integers are compared exactly.
+func compareWatermarks(a, b string) int {
+	if ia, err := strconv.ParseInt(a, 10, 64); err == nil {
+		if ib, err := strconv.ParseInt(b, 10, 64); err == nil {
+			return compare(ia < ib, ia > ib)
+		}
+	}
+	if fa, err := strconv.ParseFloat(a, 64); err == nil {
+		if fb, err := strconv.ParseFloat(b, 64); err == nil {
+			return compare(fa < fb, fa > fb)
+		}
+	}
+	if ta, err := time.Parse(time.RFC3339Nano, a); err == nil {
+		if tb, err := time.Parse(time.RFC3339Nano, b); err == nil {
+			return compare(ta.Before(tb), ta.After(tb))
+		}
+	}
+	return compare(a < b, a > b)
+}
+
+func compare(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// startWatermark prepares the set's watermark for a run, starting from the saved watermark so
+// that it never moves backwards
+func (r *RestAPI) startWatermark(now time.Time, saved string) {
+	if r.setConfig.Watermark == nil {
+		return
+	}
+	if r.setConfig.Watermark.Path == "" {
+		r.watermark = &watermarkTracker{value: now.UTC().Format(time.RFC3339)}
+		return
+	}
+	r.watermark = &watermarkTracker{path: r.setConfig.Watermark.Path, value: saved}
+}
+
+// observeWatermark updates the watermark with the values in the records
+func (r *RestAPI) observeWatermark(records []json.RawMessage) error {
+	if r.watermark == nil || r.watermark.path == "" {
+		return nil
+	}
+	for _, record := range records {
+		if err := r.watermark.observe(record); err != nil {
+			return fmt.Errorf("error reading watermark: %s", err)
+		}
+	}
+	return nil
+}
+
+// Watermark returns the high-water mark of the data read, to be saved after it is archived
+func (r *RestAPI) Watermark() string {
+	if r.watermark == nil {
+		return ""
+	}
+	return r.watermark.get()
+}
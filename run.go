@@ -1,104 +1,151 @@
 package rest_data_archiver
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/silinternational/rest-data-archiver/alert"
-	"github.com/silinternational/rest-data-archiver/aws"
 	"github.com/silinternational/rest-data-archiver/internal"
-	"github.com/silinternational/rest-data-archiver/restapi"
+
+	// Adapters register themselves with the adapter registry
+	_ "github.com/silinternational/rest-data-archiver/aws"
+	_ "github.com/silinternational/rest-data-archiver/file"
+	_ "github.com/silinternational/rest-data-archiver/restapi"
 )
 
 var appConfig internal.AppConfig
 
 func Run(configFile string) error {
-	log.SetOutput(os.Stdout)
+	// Secret values from the config must never appear in the log
+	log.SetOutput(internal.NewRedactingWriter(os.Stdout))
 	log.SetFlags(0)
-	log.Printf("Archive started at %s", time.Now().UTC().Format(time.RFC1123Z))
+	startTime := time.Now()
+	runID := internal.NewRunID(startTime)
+	log.Printf("Archive started at %s, run ID %s", startTime.UTC().Format(time.RFC1123Z), runID)
 
-	appConfig, err := internal.LoadConfig(configFile)
+	var err error
+	appConfig, err = internal.LoadConfig(configFile)
 	if err != nil {
 		sendAlert(fmt.Sprintf("Unable to load config, error: %s", err))
 		return nil
 	}
+	appConfig.Destination.RunID = runID
+	appConfig.Source.HasStateStore = appConfig.State.Type != ""
+	appConfig.Source.DryRunMode = appConfig.Runtime.DryRunMode
 
 	// Instantiate Source
-	var source internal.Source
-	switch appConfig.Source.Type {
-	case internal.SourceTypeRestAPI:
-		source, err = restapi.NewRestAPISource(appConfig.Source)
-	default:
-		err = errors.New("unrecognized source type")
-	}
-
+	source, err := internal.NewSource(appConfig.Source)
 	if err != nil {
 		sendAlert(fmt.Sprintf("Unable to initialize %s source, error: %s", appConfig.Source.Type, err))
 		return nil
 	}
 
 	// Instantiate Destination
-	var destination internal.Destination
-	switch appConfig.Destination.Type {
-	case internal.DestinationTypeS3:
-		destination, err = aws.NewS3Destination(appConfig.Destination)
-	default:
-		err = errors.New("unrecognized destination type")
+	destination, err := internal.NewDestination(appConfig.Destination)
+	if err != nil {
+		sendAlert(fmt.Sprintf("Unable to initialize %s destination, error: %s", appConfig.Destination.Type, err))
+		return nil
 	}
 
+	// Instantiate the StateStore, if configured
+	state, err := internal.NewStateStore(appConfig.State)
 	if err != nil {
-		sendAlert(fmt.Sprintf("Unable to initialize %s destination, error: %s", appConfig.Destination.Type, err))
+		sendAlert(fmt.Sprintf("Unable to initialize %s state store, error: %s", appConfig.State.Type, err))
 		return nil
 	}
 
-	maxNameLength := appConfig.MaxSetNameLength()
+	errors := runSets(appConfig, source, destination, state)
+	if len(errors) > 0 {
+		sendAlert(fmt.Sprintf("Sync error(s):\n%s", strings.Join(errors, "\n")))
+	}
+
+	log.Printf("Archive completed at %s", time.Now().UTC().Format(time.RFC1123Z))
+	return nil
+}
+
+// runSets processes the Sets using a pool of Runtime.Concurrency workers and returns the errors
+// of all sets, in the order of the Sets
+func runSets(appConfig internal.AppConfig, source internal.Source, destination internal.Destination,
+	state internal.StateStore) []string {
+	concurrency := appConfig.Runtime.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	setErrors := make([][]string, len(appConfig.Sets))
+	setIndexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range setIndexes {
+				setErrors[i] = runSet(i, appConfig, source, destination, state)
+			}
+		}()
+	}
+	for i := range appConfig.Sets {
+		setIndexes <- i
+	}
+	close(setIndexes)
+	wg.Wait()
+
 	var errors []string
+	for _, e := range setErrors {
+		errors = append(errors, e...)
+	}
+	return errors
+}
 
-	// Iterate through Sets and process changes
-	for i, set := range appConfig.Sets {
-		if set.Name == "" {
-			msg := "configuration contains a set with no name"
-			errors = append(errors, msg)
-		}
-		prefix := fmt.Sprintf("[ %-*s ] ", maxNameLength, set.Name)
-		setLogger := log.New(os.Stdout, prefix, 0)
-		setLogger.Printf("(%v/%v) Beginning archive set", i+1, len(appConfig.Sets))
-
-		// Apply Set configs (excluding source/destination as appropriate)
-		err = source.ForSet(set.Name, set.Source)
-		if err != nil {
-			msg := fmt.Sprintf(`Error setting source set on set "%s": %s`, set.Name, err)
-			setLogger.Println(msg)
-			errors = append(errors, msg)
-		}
+// runSet applies the Set configs to the source and destination and processes the set, returning
+// any errors encountered. It uses its own instances of the adapters and is safe to run
+// concurrently with other sets.
+func runSet(i int, appConfig internal.AppConfig, source internal.Source, destination internal.Destination,
+	state internal.StateStore) []string {
+	set := appConfig.Sets[i]
+	var errors []string
+	if set.Name == "" {
+		msg := "configuration contains a set with no name"
+		errors = append(errors, msg)
+	}
+	prefix := fmt.Sprintf("[ %-*s ] ", appConfig.MaxSetNameLength(), set.Name)
+	setLogger := log.New(internal.NewRedactingWriter(os.Stdout), prefix, 0)
+	setLogger.Printf("(%v/%v) Beginning archive set", i+1, len(appConfig.Sets))
 
-		err = destination.ForSet(set.Name, set.Destination)
-		if err != nil {
-			msg := fmt.Sprintf(`Error setting destination set on set "%s": %s`, set.Name, err)
-			setLogger.Println(msg)
-			errors = append(errors, msg)
-		}
+	// Apply Set configs (excluding source/destination as appropriate)
+	setSource, err := source.ForSet(set.Name, set.Source)
+	if err != nil {
+		msg := fmt.Sprintf(`Error setting source set on set "%s": %s`, set.Name, err)
+		setLogger.Println(msg)
+		return append(errors, msg)
+	}
 
-		if err := internal.RunSet(setLogger, source, destination, appConfig); err != nil {
-			msg := fmt.Sprintf(`Archive failed with error on set "%s": %s`, set.Name, err)
-			setLogger.Println(msg)
-			errors = append(errors, msg)
-		}
+	setDestination, err := destination.ForSet(set.Name, set.Destination)
+	if err != nil {
+		msg := fmt.Sprintf(`Error setting destination set on set "%s": %s`, set.Name, err)
+		setLogger.Println(msg)
+		return append(errors, msg)
 	}
 
-	if len(errors) > 0 {
-		sendAlert(fmt.Sprintf("Sync error(s):\n%s", strings.Join(errors, "\n")))
+	if err := internal.RunSet(setLogger, set, setSource, setDestination, state, appConfig); err != nil {
+		msg := fmt.Sprintf(`Archive failed with error on set "%s": %s`, set.Name, err)
+		setLogger.Println(msg)
+		// An error that was already sent as an alert is only logged
+		if !internal.IsAlerted(err) {
+			errors = append(errors, msg)
+		}
 	}
 
-	log.Printf("Archive completed at %s", time.Now().UTC().Format(time.RFC1123Z))
-	return nil
+	setLogger.Printf("(%v/%v) Finished archive set", i+1, len(appConfig.Sets))
+	return errors
 }
 
 func sendAlert(msg string) {
+	msg = internal.RedactSecrets(msg)
 	log.Println(msg)
 	alert.SendEmail(appConfig.Alert, msg)
 }
@@ -0,0 +1,213 @@
+package rest_data_archiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/silinternational/rest-data-archiver/aws"
+	"github.com/silinternational/rest-data-archiver/file"
+	"github.com/silinternational/rest-data-archiver/internal"
+	"github.com/silinternational/rest-data-archiver/restapi"
+)
+
+// fakeSource reads data that names its set after the set's delay. Sets named "fail..." return an
+// error, and sets named "alerted..." return an error that was already alerted.
+type fakeSource struct {
+	delays  map[string]time.Duration
+	setName string
+	running *inFlight
+}
+
+type inFlight struct {
+	mutex   sync.Mutex
+	current int
+	max     int
+}
+
+func (f *fakeSource) ForSet(setName string, setJson json.RawMessage) (internal.Source, error) {
+	return &fakeSource{delays: f.delays, setName: setName, running: f.running}, nil
+}
+
+func (f *fakeSource) Read() ([]byte, error) {
+	f.running.mutex.Lock()
+	f.running.current++
+	if f.running.current > f.running.max {
+		f.running.max = f.running.current
+	}
+	f.running.mutex.Unlock()
+
+	time.Sleep(f.delays[f.setName])
+
+	f.running.mutex.Lock()
+	f.running.current--
+	f.running.mutex.Unlock()
+
+	switch {
+	case strings.HasPrefix(f.setName, "fail"):
+		return nil, fmt.Errorf("%s failed", f.setName)
+	case strings.HasPrefix(f.setName, "alerted"):
+		return nil, &internal.AlertedError{Err: errors.New("already alerted")}
+	}
+	return []byte(`{"set":"` + f.setName + `"}`), nil
+}
+
+// fakeDestination records the data written for each set
+type fakeDestination struct {
+	mutex   *sync.Mutex
+	written map[string]string
+	setName string
+}
+
+func (f *fakeDestination) ForSet(setName string, setJson json.RawMessage) (internal.Destination, error) {
+	return &fakeDestination{mutex: f.mutex, written: f.written, setName: setName}, nil
+}
+
+func (f *fakeDestination) Write(data []byte, eventLog chan<- internal.EventLogItem) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.written[f.setName] = string(data)
+	return nil
+}
+
+func Test_runSets(t *testing.T) {
+	// Earlier sets take longer, so that they finish after later sets
+	names := []string{"fail1", "users", "alerted", "fail2", "groups", "roles", "fail3", "sites"}
+	delays := map[string]time.Duration{}
+	sets := make([]internal.Set, len(names))
+	for i, name := range names {
+		delays[name] = time.Duration(len(names)-i) * 10 * time.Millisecond
+		sets[i] = internal.Set{Name: name}
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			source := &fakeSource{delays: delays, running: &inFlight{}}
+			destination := &fakeDestination{mutex: &sync.Mutex{}, written: map[string]string{}}
+			appConfig := internal.AppConfig{Runtime: internal.RuntimeConfig{Concurrency: concurrency}, Sets: sets}
+
+			errs := runSets(appConfig, source, destination, nil)
+
+			require.Len(t, errs, 3, "errors: %v", errs)
+			for i, name := range []string{"fail1", "fail2", "fail3"} {
+				require.Contains(t, errs[i], fmt.Sprintf(`set "%s"`, name))
+			}
+			require.Len(t, destination.written, 4)
+			for _, name := range []string{"users", "groups", "roles", "sites"} {
+				require.Equal(t, `{"set":"`+name+`"}`, destination.written[name])
+			}
+			require.Equal(t, concurrency, source.running.max)
+			require.Equal(t, "", destination.setName, "the base destination should be unchanged")
+			require.Equal(t, "", source.setName, "the base source should be unchanged")
+		})
+	}
+}
+
+func TestForSet_LeavesReceiverUnchanged(t *testing.T) {
+	source, err := internal.NewSource(internal.SourceConfig{
+		Type:          internal.SourceTypeRestAPI,
+		AdapterConfig: json.RawMessage(`{"BaseURL":"https://example.com","AuthType":"apikey","Password":"key"}`),
+	})
+	require.NoError(t, err)
+	sourceSets := []string{
+		`{"Path":"users","Headers":{"X-Set":"1"},"Pagination":{"Type":"Offset"}}`,
+		`{"Path":"/groups","Query":{"q":"{{.SetName}}"},"Watermark":{"Path":"modified"}}`,
+		`{"Path":"/roles","Validation":{"MinRecords":1}}`,
+	}
+
+	s3Destination, err := internal.NewDestination(internal.DestinationConfig{
+		Type: internal.DestinationTypeS3,
+		AdapterConfig: json.RawMessage(`{"BucketName":"archive","AwsConfig":{"Region":"us-east-1"},` +
+			`"Compression":"gzip","Retention":{"KeepLast":2},"Upload":{"Tags":{"a":"b"}}}`),
+	})
+	require.NoError(t, err)
+	s3Sets := []string{
+		`{}`,
+		`{"Compression":"none","ObjectKeyTemplate":"{set}/{timestamp}.{ext}","Upload":{"Tags":{"c":"d"}}}`,
+		`{"Format":{"Type":"parquet"},"Retention":{"KeepDays":7}}`,
+	}
+
+	fileDestination, err := internal.NewDestination(internal.DestinationConfig{
+		Type:          internal.DestinationTypeFile,
+		AdapterConfig: json.RawMessage(`{"RootDirectory":"` + t.TempDir() + `"}`),
+	})
+	require.NoError(t, err)
+	fileSets := []string{`{}`, `{"ObjectNamePrefix":"other/data_"}`, `{}`}
+
+	restAPI := *source.(*restapi.RestAPI)
+	s3Adapter := *s3Destination.(*aws.S3Adapter)
+	fileAdapter := *fileDestination.(*file.FileAdapter)
+
+	// Configure the sets concurrently, as Run does, so that the race detector can find shared state
+	var wg sync.WaitGroup
+	errs := make([]error, len(sourceSets))
+	for i := range sourceSets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("set%d", i)
+			if _, err := source.ForSet(name, json.RawMessage(sourceSets[i])); err != nil {
+				errs[i] = err
+				return
+			}
+			if _, err := s3Destination.ForSet(name, json.RawMessage(s3Sets[i])); err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = fileDestination.ForSet(name, json.RawMessage(fileSets[i]))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, restAPI, *source.(*restapi.RestAPI))
+	require.Equal(t, s3Adapter, *s3Destination.(*aws.S3Adapter))
+	require.Equal(t, fileAdapter, *fileDestination.(*file.FileAdapter))
+}
+
+// metadataDestination is a destination implemented with only the exported types, as it would be
+// outside of this module
+type metadataDestination struct {
+	source MetadataSource
+}
+
+func (m *metadataDestination) ForSet(setName string, setJson json.RawMessage) (Destination, error) {
+	return m, nil
+}
+
+func (m *metadataDestination) Write(data []byte, eventLog chan<- EventLogItem) error {
+	return &AlertedError{Err: errors.New("already alerted")}
+}
+
+func (m *metadataDestination) SetMetadataSource(source MetadataSource) {
+	m.source = source
+}
+
+func TestExportedAdapterTypes(t *testing.T) {
+	var destination Destination = &metadataDestination{}
+	_, ok := destination.(MetadataDestination)
+	require.True(t, ok, "a destination outside of the module should be able to implement MetadataDestination")
+
+	err := destination.Write(nil, nil)
+	require.True(t, IsAlerted(err))
+	require.True(t, IsAlerted(fmt.Errorf("wrapped: %w", err)))
+	require.False(t, IsAlerted(errors.New("not alerted")))
+}
+
+func TestUnmarshalConfig(t *testing.T) {
+	var config struct {
+		AccountID string
+		Port      int
+	}
+	require.NoError(t, UnmarshalConfig([]byte(`{"AccountID":123456,"Port":"8080"}`), &config))
+	require.Equal(t, "123456", config.AccountID)
+	require.Equal(t, 8080, config.Port)
+}